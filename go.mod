@@ -8,6 +8,7 @@ require (
 	github.com/prometheus/common v0.10.0 // indirect
 	github.com/shadowsocks/go-shadowsocks2 v0.1.0
 	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
+	golang.org/x/net v0.0.0-20200520182314-0ba52f642ac2
 	golang.org/x/sys v0.0.0-20200513112337-417ce2331b5c // indirect
 	gopkg.in/yaml.v2 v2.3.0
 )
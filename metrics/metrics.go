@@ -64,6 +64,7 @@ type shadowsocksMetrics struct {
 
 	udpAddedNatEntries   prometheus.Counter
 	udpRemovedNatEntries prometheus.Counter
+	udpActiveNatEntries  prometheus.Gauge
 }
 
 func newShadowsocksMetrics(ipCountryDB *geoip2.Reader) *shadowsocksMetrics {
@@ -144,6 +145,13 @@ func newShadowsocksMetrics(ipCountryDB *geoip2.Reader) *shadowsocksMetrics {
 				Name:      "nat_entries_removed",
 				Help:      "Entries removed from the UDP NAT table",
 			}),
+		udpActiveNatEntries: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "udp",
+				Name:      "nat_entries_active",
+				Help:      "Entries in the UDP NAT table, each with a goroutine reading from the target",
+			}),
 	}
 }
 
@@ -155,7 +163,7 @@ func NewPrometheusShadowsocksMetrics(ipCountryDB *geoip2.Reader, registerer prom
 	m := newShadowsocksMetrics(ipCountryDB)
 	// TODO: Is it possible to pass where to register the collectors?
 	registerer.MustRegister(m.buildInfo, m.accessKeys, m.ports, m.tcpOpenConnections, m.tcpProbes, m.tcpClosedConnections, m.tcpConnectionDurationMs,
-		m.dataBytes, m.timeToCipherMs, m.udpAddedNatEntries, m.udpRemovedNatEntries)
+		m.dataBytes, m.timeToCipherMs, m.udpAddedNatEntries, m.udpRemovedNatEntries, m.udpActiveNatEntries)
 	return m
 }
 
@@ -242,10 +250,12 @@ func (m *shadowsocksMetrics) AddUDPPacketFromTarget(clientLocation, accessKey, s
 
 func (m *shadowsocksMetrics) AddUDPNatEntry() {
 	m.udpAddedNatEntries.Inc()
+	m.udpActiveNatEntries.Inc()
 }
 
 func (m *shadowsocksMetrics) RemoveUDPNatEntry() {
 	m.udpRemovedNatEntries.Inc()
+	m.udpActiveNatEntries.Dec()
 }
 
 type ProxyMetrics struct {
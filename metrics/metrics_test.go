@@ -7,6 +7,7 @@ import (
 
 	geoip2 "github.com/oschwald/geoip2-golang"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestMethodsDontPanic(t *testing.T) {
@@ -27,6 +28,23 @@ func TestMethodsDontPanic(t *testing.T) {
 	ssMetrics.RemoveUDPNatEntry()
 }
 
+func TestUDPNatEntryMetrics(t *testing.T) {
+	ssMetrics := newShadowsocksMetrics(nil)
+	for i := 0; i < 3; i++ {
+		ssMetrics.AddUDPNatEntry()
+	}
+	ssMetrics.RemoveUDPNatEntry()
+	if added := testutil.ToFloat64(ssMetrics.udpAddedNatEntries); added != 3 {
+		t.Errorf("Expected 3 added entries, got %v", added)
+	}
+	if removed := testutil.ToFloat64(ssMetrics.udpRemovedNatEntries); removed != 1 {
+		t.Errorf("Expected 1 removed entry, got %v", removed)
+	}
+	if active := testutil.ToFloat64(ssMetrics.udpActiveNatEntries); active != 2 {
+		t.Errorf("Expected 2 active entries, got %v", active)
+	}
+}
+
 func BenchmarkGetLocation(b *testing.B) {
 	var ipCountryDB *geoip2.Reader
 	// The test data is in a git submodule that must be initialized before running the test.
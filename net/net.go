@@ -3,6 +3,7 @@ package net
 import (
 	"io"
 	"net"
+	"sync"
 )
 
 // DuplexConn is a net.Conn that allows for closing only the reader or writer end of
@@ -67,18 +68,41 @@ func copyOneWay(leftConn, rightConn DuplexConn) (int64, error) {
 // Relay allows for half-closed connections: if one side is done writing, it can
 // still read all remaining data from its peer.
 func Relay(leftConn, rightConn DuplexConn) (int64, int64, error) {
+	return relay(leftConn, rightConn, false)
+}
+
+// RelayHalfClose is like Relay, but if copying in either direction fails, it
+// closes both connections.  Otherwise, the other direction could wait
+// indefinitely for a peer that will never finish.  Clean EOFs still only
+// close the corresponding write end, so half-closed connections are supported.
+func RelayHalfClose(leftConn, rightConn DuplexConn) (int64, int64, error) {
+	return relay(leftConn, rightConn, true)
+}
+
+func relay(leftConn, rightConn DuplexConn, closeOnError bool) (int64, int64, error) {
 	type res struct {
 		N   int64
 		Err error
 	}
 	ch := make(chan res)
+	var closeOnce sync.Once
+	copyAndClose := func(dst, src DuplexConn) (int64, error) {
+		n, err := copyOneWay(dst, src)
+		if err != nil && closeOnError {
+			closeOnce.Do(func() {
+				leftConn.Close()
+				rightConn.Close()
+			})
+		}
+		return n, err
+	}
 
 	go func() {
-		n, err := copyOneWay(rightConn, leftConn)
+		n, err := copyAndClose(rightConn, leftConn)
 		ch <- res{n, err}
 	}()
 
-	n, err := copyOneWay(leftConn, rightConn)
+	n, err := copyAndClose(leftConn, rightConn)
 	rs := <-ch
 
 	if err == nil {
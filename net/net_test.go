@@ -0,0 +1,137 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns both ends of a loopback TCP connection.
+func makeTCPPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer listener.Close()
+	dialed, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	accepted, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatalf("AcceptTCP failed: %v", err)
+	}
+	return dialed, accepted
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	client, left := makeTCPPair(t)
+	defer client.Close()
+	right, target := makeTCPPair(t)
+	defer target.Close()
+
+	type result struct {
+		rightToLeft, leftToRight int64
+		err                      error
+	}
+	done := make(chan result)
+	go func() {
+		r2l, l2r, err := RelayHalfClose(left, right)
+		done <- result{r2l, l2r, err}
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	target.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("hello"))
+	client.CloseWrite()
+	request, err := ioutil.ReadAll(target)
+	if err != nil || string(request) != "hello" {
+		t.Fatalf("Target read %q, %v", request, err)
+	}
+	// The target can still respond after the client has finished writing.
+	target.Write([]byte("world!"))
+	target.CloseWrite()
+	response, err := ioutil.ReadAll(client)
+	if err != nil || string(response) != "world!" {
+		t.Fatalf("Client read %q, %v", response, err)
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Errorf("Relay failed: %v", r.err)
+	}
+	if r.rightToLeft != 6 || r.leftToRight != 5 {
+		t.Errorf("Wrong byte counts: %d, %d", r.rightToLeft, r.leftToRight)
+	}
+}
+
+// A DuplexConn whose reads always fail.
+type failingConn struct {
+	DuplexConn
+	closed chan struct{}
+}
+
+func (c *failingConn) Read(b []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *failingConn) CloseRead() error {
+	return nil
+}
+
+func (c *failingConn) CloseWrite() error {
+	return nil
+}
+
+func (c *failingConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestRelayHalfCloseError(t *testing.T) {
+	left := &failingConn{closed: make(chan struct{})}
+	right, target := makeTCPPair(t)
+	defer target.Close()
+
+	done := make(chan error)
+	go func() {
+		_, _, err := RelayHalfClose(left, right)
+		done <- err
+	}()
+
+	// The target never writes or closes, so the relay only finishes if
+	// the failure closes both connections.
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay did not finish after a read error")
+	}
+	select {
+	case <-left.closed:
+	default:
+		t.Error("Left connection was not closed")
+	}
+}
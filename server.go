@@ -176,6 +176,12 @@ func (s *SSServer) Stop() error {
 	return nil
 }
 
+// RegisterMetrics reports the server's replay cache statistics to Prometheus via
+// `registerer`, which should be the one given to the server's metrics.
+func (s *SSServer) RegisterMetrics(registerer prometheus.Registerer) error {
+	return registerer.Register(s.replayCache.Collector())
+}
+
 // RunSSServer starts a shadowsocks server running, and returns the server or an error.
 func RunSSServer(filename string, natTimeout time.Duration, sm metrics.ShadowsocksMetrics, replayHistory int) (*SSServer, error) {
 	server := &SSServer{
@@ -274,12 +280,16 @@ func main() {
 		}
 		defer ipCountryDB.Close()
 	}
-	m := metrics.NewPrometheusShadowsocksMetrics(ipCountryDB, prometheus.DefaultRegisterer)
+	registerer := prometheus.DefaultRegisterer
+	m := metrics.NewPrometheusShadowsocksMetrics(ipCountryDB, registerer)
 	m.SetBuildInfo(version)
-	_, err = RunSSServer(flags.ConfigFile, flags.natTimeout, m, flags.replayHistory)
+	server, err := RunSSServer(flags.ConfigFile, flags.natTimeout, m, flags.replayHistory)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	if err := server.RegisterMetrics(registerer); err != nil {
+		logger.Fatalf("Failed to register metrics: %v", err)
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/Jigsaw-Code/outline-ss-server/metrics"
+	"github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -32,3 +33,21 @@ func TestRunSSServer(t *testing.T) {
 		t.Errorf("Error while stopping server: %v", err)
 	}
 }
+
+func TestSSServer_RegisterMetrics(t *testing.T) {
+	server := &SSServer{replayCache: shadowsocks.NewReplayCache(10)}
+	// Each registry takes the server's metrics, without touching the default one.
+	for i := 0; i < 2; i++ {
+		registry := prometheus.NewRegistry()
+		if err := server.RegisterMetrics(registry); err != nil {
+			t.Fatalf("RegisterMetrics failed: %v", err)
+		}
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("Gather failed: %v", err)
+		}
+		if len(families) == 0 {
+			t.Error("No metrics were registered")
+		}
+	}
+}
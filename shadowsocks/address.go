@@ -0,0 +1,43 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// ReadTargetAddress reads the SOCKS address that a client sends at the start of
+// a decrypted Shadowsocks stream, and returns the destination host and port.
+// The host is an IPv4 or IPv6 literal, or a domain name.
+func ReadTargetAddress(r io.Reader) (host string, port int, err error) {
+	addr, err := socks.ReadAddr(r)
+	if err != nil {
+		return "", 0, err
+	}
+	switch addr[0] {
+	case socks.AtypDomainName:
+		host = string(addr[2 : 2+int(addr[1])])
+	case socks.AtypIPv4:
+		host = net.IP(addr[1 : 1+net.IPv4len]).String()
+	case socks.AtypIPv6:
+		host = net.IP(addr[1 : 1+net.IPv6len]).String()
+	}
+	port = int(binary.BigEndian.Uint16(addr[len(addr)-2:]))
+	return host, port, nil
+}
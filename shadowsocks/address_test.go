@@ -0,0 +1,59 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestReadTargetAddress(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		host    string
+		port    int
+	}{
+		{"192.0.2.1:80", "192.0.2.1", 80},
+		{"[2001:db8::1]:443", "2001:db8::1", 443},
+		{"example.com:65535", "example.com", 65535},
+	} {
+		payload := append(socks.ParseAddr(tc.address), "data"...)
+		r := bytes.NewReader(payload)
+		host, port, err := ReadTargetAddress(r)
+		if err != nil {
+			t.Errorf("Failed to read %v: %v", tc.address, err)
+			continue
+		}
+		if host != tc.host || port != tc.port {
+			t.Errorf("Wrong address for %v: host %v, port %v", tc.address, host, port)
+		}
+		if r.Len() != len("data") {
+			t.Errorf("Read past the address for %v: %d bytes left", tc.address, r.Len())
+		}
+	}
+}
+
+func TestReadTargetAddressErrors(t *testing.T) {
+	// Unsupported address type.
+	if _, _, err := ReadTargetAddress(bytes.NewReader([]byte{2, 1, 2, 3, 4, 0, 80})); err == nil {
+		t.Error("Expected error for unsupported address type")
+	}
+	// Truncated IPv4 address.
+	if _, _, err := ReadTargetAddress(bytes.NewReader([]byte{socks.AtypIPv4, 1, 2})); err == nil {
+		t.Error("Expected error for truncated address")
+	}
+}
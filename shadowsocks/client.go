@@ -1,9 +1,17 @@
 package shadowsocks
 
 import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	mrand "math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
@@ -17,27 +25,183 @@ type Client interface {
 	// DialTCP connects to `raddr` over TCP though a Shadowsocks proxy.
 	// `laddr` is a local bind address, a local address is automatically chosen if nil.
 	// `raddr` has the form `host:port`, where `host` can be a domain name or IP address.
+	// The returned connection is a *StreamConn.
 	DialTCP(laddr *net.TCPAddr, raddr string) (onet.DuplexConn, error)
 
 	// ListenUDP relays UDP packets though a Shadowsocks proxy.
 	// `laddr` is a local bind address, a local address is automatically chosen if nil.
+	// The returned PacketConn also implements `Metrics() PacketConnMetrics`,
+	// `SetReplyHook(func(src net.Addr))`, `MigrateProxy(*net.UDPAddr) error`
+	// and BatchPacketConn.
 	ListenUDP(laddr *net.UDPAddr) (net.PacketConn, error)
 }
 
+// ClientObserver receives the lifecycle events of the TCP connections made by a
+// Client.  Its methods may be called concurrently, and must not block.
+type ClientObserver interface {
+	// OnDialStart is called when a dial starts.
+	OnDialStart()
+	// OnDialEnd is called when a dial finishes, after the TLS handshake and the
+	// initial payload, if any.  `err` is nil if the dial succeeded.
+	OnDialEnd(err error, duration time.Duration)
+	// OnClose is called on the first Close of a successfully dialed
+	// connection, with the number of bytes sent to and received from the
+	// proxy.  These include the Shadowsocks framing, but not TLS.
+	OnClose(bytesUp, bytesDown int64)
+}
+
+// ErrTooManyUDPConns is returned when a Client's limit on open UDP connections,
+// set by WithMaxUDPConns, has been reached.
+var ErrTooManyUDPConns = errors.New("too many open UDP connections")
+
+// ClientOption configures a Client when it is created.  Settings can't be
+// changed afterwards, so they are safe to read from concurrent dials.
+type ClientOption func(c *ssClient) error
+
+// WithDialTimeout bounds the TCP connection to the proxy, the TLS handshake if
+// any, and the write of the target address and the initial payload.  The
+// default is 10 seconds, and 0 disables the timeout.
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return func(c *ssClient) error {
+		c.dialTimeout = timeout
+		return nil
+	}
+}
+
+// WithTCPFastOpen enables TCP Fast Open for connections to the proxy, where
+// supported (currently Linux).  The first write of each connection, such as
+// the target address and payload of DialTCPWithPayload, then travels in the
+// SYN once the kernel has a Fast Open cookie for the proxy, saving a round
+// trip.  Without a cookie, the connection uses a normal handshake.  Connection
+// errors are reported by the first write or read, rather than by the dial.
+func WithTCPFastOpen(enabled bool) ClientOption {
+	return func(c *ssClient) error {
+		c.tcpFastOpen = enabled
+		return nil
+	}
+}
+
+// WithTCPNoDelay sets TCP_NODELAY on connections to the proxy.  If true, the
+// default, small writes such as interactive traffic are sent immediately.
+// If false, the Nagle algorithm may delay them in order to combine them
+// into fewer, larger segments, which can help bulk transfers made of small
+// writes.
+func WithTCPNoDelay(noDelay bool) ClientOption {
+	return func(c *ssClient) error {
+		c.tcpNoDelay = noDelay
+		return nil
+	}
+}
+
+// WithIdleKeepAlive makes each TCP connection send an empty Shadowsocks chunk
+// after it has been idle for about `interval`, so that NAT mappings on the
+// path to the proxy don't expire.  The interval is jittered by up to 50%.
+// Readers in this package, including the server's, skip empty chunks, so
+// the target never sees them.  0, the default, disables keepalives.
+func WithIdleKeepAlive(interval time.Duration) ClientOption {
+	return func(c *ssClient) error {
+		c.idleKeepAlive = interval
+		return nil
+	}
+}
+
+// WithObserver makes the client report the lifecycle of its TCP connections
+// to `observer`, e.g. to record metrics.  A nil observer, the default,
+// disables reporting.
+func WithObserver(observer ClientObserver) ClientOption {
+	return func(c *ssClient) error {
+		c.observer = observer
+		return nil
+	}
+}
+
+// WithMaxUDPConns limits the number of open PacketConns returned by
+// ListenUDP, ListenUDPContext and Dial to `max`, protecting against file
+// descriptor exhaustion.  Beyond the limit, they fail with ErrTooManyUDPConns
+// until a PacketConn is closed.  0, the default, means no limit.
+func WithMaxUDPConns(max int) ClientOption {
+	return func(c *ssClient) error {
+		c.udpSlots = nil
+		if max > 0 {
+			c.udpSlots = make(chan struct{}, max)
+		}
+		return nil
+	}
+}
+
+// WithTLS makes the client tunnel its TCP connections to the proxy inside TLS,
+// configured by `config`, to disguise the Shadowsocks traffic.  Set
+// config.ServerName to choose the SNI.  UDP is not affected.  A nil config, the
+// default, disables TLS.
+func WithTLS(config *tls.Config) ClientOption {
+	return func(c *ssClient) error {
+		c.tlsConfig = config
+		return nil
+	}
+}
+
+// WithUDPBufferSize sets the size of the buffers in which UDP connections
+// encrypt and decrypt datagrams, which bounds the size of the datagrams
+// exchanged with the proxy, including the salt, the SOCKS address and the
+// AEAD tag.  The SOCKS5 relay of ServeSOCKS5UDP uses the same size.  The
+// default is 16 KiB, and 0 restores it.  Other sizes must be at least 307
+// bytes, room for the largest salt, SOCKS address and tag, and at most 65507
+// bytes, the largest UDP payload over IPv4.
+func WithUDPBufferSize(size int) ClientOption {
+	return func(c *ssClient) error {
+		if size != 0 && (size < minUDPBufferSize || size > maxUDPPayloadSize) {
+			return fmt.Errorf("Invalid UDP buffer size %d: must be 0, or between %d and %d", size, minUDPBufferSize, maxUDPPayloadSize)
+		}
+		c.udpBufPool = nil
+		if size > 0 && size != maxUDPBufferSize {
+			c.udpBufPool = newUDPBufferPool(size)
+		}
+		return nil
+	}
+}
+
+// udpBuffers returns the pool of the client's UDP buffers.
+func (c *ssClient) udpBuffers() *sync.Pool {
+	if c.udpBufPool == nil {
+		return pool
+	}
+	return c.udpBufPool
+}
+
 // NewClient creates a client that routes connections to a Shadowsocks proxy listening at
-// `host:port`, with authentication parameters `cipher` (AEAD) and `password`.
+// `host:port`, with authentication parameters `cipher` (AEAD) and `password`, and
+// configured by `options`.
+//
+// The derived key is shared with later clients that have the same credentials.
+// The keys of the 16 most recently used credentials stay in memory for this
+// purpose, even after their clients are gone.  To avoid this, derive the
+// cipher with go-shadowsocks2 and use NewClientWithCipher.
 // TODO: add a dialer argument to support proxy chaining and transport changes.
-func NewClient(host string, port int, password, cipher string) (Client, error) {
+func NewClient(host string, port int, password, cipher string, options ...ClientOption) (Client, error) {
+	aead, err := newAeadCipher(cipher, password)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithCipher(host, port, aead, options...)
+}
+
+// NewClientWithCipher is like NewClient, but it takes an already derived `cipher`,
+// which may be shared with other clients, or be a custom implementation.
+func NewClientWithCipher(host string, port int, cipher shadowaead.Cipher, options ...ClientOption) (Client, error) {
+	if cipher == nil {
+		return nil, errors.New("Cipher must not be nil")
+	}
 	// TODO: consider using net.LookupIP to get a list of IPs, and add logic for optimal selection.
 	proxyIP, err := net.ResolveIPAddr("ip", host)
 	if err != nil {
 		return nil, errors.New("Failed to resolve proxy address")
 	}
-	aead, err := newAeadCipher(cipher, password)
-	if err != nil {
-		return nil, err
+	d := ssClient{proxyIP: proxyIP.IP, proxyPort: port, cipher: cipher, dialTimeout: defaultDialTimeout, tcpNoDelay: true}
+	for _, option := range options {
+		if err := option(&d); err != nil {
+			return nil, err
+		}
 	}
-	d := ssClient{proxyIP: proxyIP.IP, proxyPort: port, cipher: aead}
 	return &d, nil
 }
 
@@ -45,6 +209,44 @@ type ssClient struct {
 	proxyIP   net.IP
 	proxyPort int
 	cipher    shadowaead.Cipher
+	// If not nil, TCP connections to the proxy use TLS.
+	tlsConfig   *tls.Config
+	dialTimeout time.Duration
+	tcpFastOpen bool
+	tcpNoDelay  bool
+	// Interval for empty keepalive chunks, or 0 if disabled.
+	idleKeepAlive time.Duration
+	observer      ClientObserver
+	// Holds a value for each open UDP connection, or nil if there is no limit.
+	udpSlots chan struct{}
+	// Pool of UDP buffers, or nil for the default size.
+	udpBufPool *sync.Pool
+}
+
+// defaultDialTimeout is long enough for slow networks, but stops a proxy that
+// accepts connections and then stalls from hanging the dial.
+const defaultDialTimeout = 10 * time.Second
+
+// observeDial reports the start of a dial to the observer, if any, and returns
+// the function that reports its result.
+func (c *ssClient) observeDial() func(err error) {
+	if c.observer == nil {
+		return func(error) {}
+	}
+	c.observer.OnDialStart()
+	start := time.Now()
+	return func(err error) {
+		c.observer.OnDialEnd(err, time.Since(start))
+	}
+}
+
+// dialDeadline returns the deadline for a dial that starts now, or the zero
+// time if there is no timeout.
+func (c *ssClient) dialDeadline() time.Time {
+	if c.dialTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.dialTimeout)
 }
 
 // This code contains an optimization to send the initial client payload along with
@@ -60,75 +262,578 @@ type ssClient struct {
 const helloWait = 10 * time.Millisecond
 
 func (c *ssClient) DialTCP(laddr *net.TCPAddr, raddr string) (onet.DuplexConn, error) {
-	socksTargetAddr := socks.ParseAddr(raddr)
-	if socksTargetAddr == nil {
-		return nil, errors.New("Failed to parse target address")
+	dialEnd := c.observeDial()
+	proxyConn, rawConn, ssw, err := c.dialTCP(laddr, raddr)
+	dialEnd(err)
+	if err != nil {
+		return nil, err
 	}
-	proxyAddr := &net.TCPAddr{IP: c.proxyIP, Port: c.proxyPort}
-	proxyConn, err := net.DialTCP("tcp", laddr, proxyAddr)
+	conn := c.newStreamConn(proxyConn, rawConn, ssw)
+	time.AfterFunc(helloWait, func() {
+		conn.flushTargetAddr(c.dialTimeout)
+	})
+	return conn, nil
+}
+
+// DialTCPWithPayload is like c.DialTCP, but it sends `payload` immediately, in the
+// same Shadowsocks chunk as the target address.  This is for callers that already
+// have the initial payload, and would rather not wait for DialTCP's hello delay.
+// For clients not created by this package, it writes `payload` after c.DialTCP.
+func DialTCPWithPayload(c Client, laddr *net.TCPAddr, raddr string, payload []byte) (onet.DuplexConn, error) {
+	if ssc, ok := c.(*ssClient); ok {
+		return ssc.dialTCPWithPayload(laddr, raddr, payload)
+	}
+	conn, err := c.DialTCP(laddr, raddr)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := conn.Write(payload); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to write initial payload: %w", err)
+	}
+	return conn, nil
+}
+
+func (c *ssClient) dialTCPWithPayload(laddr *net.TCPAddr, raddr string, payload []byte) (conn onet.DuplexConn, err error) {
+	dialEnd := c.observeDial()
+	defer func() { dialEnd(err) }()
+	proxyConn, rawConn, ssw, err := c.dialTCP(laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	// Write sends the queued target address together with the payload.
+	proxyConn.SetWriteDeadline(c.dialDeadline())
+	if _, err := ssw.Write(payload); err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("Failed to write initial payload: %w", err)
+	}
+	proxyConn.SetWriteDeadline(time.Time{})
+	return c.newStreamConn(proxyConn, rawConn, ssw), nil
+}
+
+// StreamConn is a TCP connection to a target through a Shadowsocks proxy.
+// It gives access to the underlying connection, e.g. to set socket options.
+type StreamConn struct {
+	onet.DuplexConn
+	rawConn *net.TCPConn
+	cipher  shadowaead.Cipher
+	reader  RekeyingReader
+	writer  *Writer
+	// Closed to stop the keepalive goroutine, if any.
+	stopKeepAlive     chan struct{}
+	stopKeepAliveOnce sync.Once
+	// If not nil, receives OnClose, with the bytes read counted by proxyReader.
+	observer    ClientObserver
+	proxyReader *countingReader
+	closeOnce   sync.Once
+	// deadlineMu protects writeDeadline, which is the write deadline set by the
+	// caller, so that flushTargetAddr can restore it.
+	deadlineMu    sync.Mutex
+	writeDeadline time.Time
+	// Holds the error of flushTargetAddr, if it failed.
+	flushErr atomic.Value
+}
+
+func (c *ssClient) newStreamConn(proxyConn onet.DuplexConn, rawConn *net.TCPConn, ssw *Writer) *StreamConn {
+	conn := &StreamConn{
+		rawConn:       rawConn,
+		cipher:        c.cipher,
+		writer:        ssw,
+		stopKeepAlive: make(chan struct{}),
+	}
+	var proxyReader io.Reader = proxyConn
+	if c.observer != nil {
+		conn.observer = c.observer
+		conn.proxyReader = &countingReader{Reader: proxyConn}
+		proxyReader = conn.proxyReader
+	}
+	conn.reader = NewShadowsocksReader(proxyReader, c.cipher).(RekeyingReader)
+	conn.DuplexConn = onet.WrapConn(proxyConn, conn.reader, ssw)
+	if c.idleKeepAlive > 0 {
+		go conn.keepAlive(c.idleKeepAlive)
+	}
+	return conn
+}
+
+// keepAlive sends an empty chunk whenever nothing was written for a jittered
+// `interval`, until the write side is closed or a write fails.
+func (c *StreamConn) keepAlive(interval time.Duration) {
+	lastWireBytes := c.writer.WireBytes()
+	for {
+		timer := time.NewTimer(interval/2 + time.Duration(mrand.Int63n(int64(interval))))
+		select {
+		case <-c.stopKeepAlive:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if wireBytes := c.writer.WireBytes(); wireBytes != lastWireBytes {
+			// The connection isn't idle.
+			lastWireBytes = wireBytes
+			continue
+		}
+		if err := c.writer.KeepAlive(); err != nil {
+			return
+		}
+		lastWireBytes = c.writer.WireBytes()
+	}
+}
+
+// flushTargetAddr sends the target address queued by DialTCP, unless a write
+// has already sent it.  The write is bounded by `timeout`, if positive, so
+// that a stalled proxy can't hold it forever.  If it fails, the connection is
+// closed, and the error is returned by the following reads and writes.
+func (c *StreamConn) flushTargetAddr(timeout time.Duration) {
+	if timeout > 0 {
+		c.deadlineMu.Lock()
+		deadline := time.Now().Add(timeout)
+		if !c.writeDeadline.IsZero() && c.writeDeadline.Before(deadline) {
+			deadline = c.writeDeadline
+		}
+		c.DuplexConn.SetWriteDeadline(deadline)
+		c.deadlineMu.Unlock()
+	}
+	err := c.writer.Flush()
+	if timeout > 0 {
+		c.deadlineMu.Lock()
+		c.DuplexConn.SetWriteDeadline(c.writeDeadline)
+		c.deadlineMu.Unlock()
+	}
+	if err != nil {
+		c.flushErr.Store(fmt.Errorf("Failed to write target address: %w", err))
+		c.Close()
+	}
+}
+
+// checkFlush replaces `err` with the error of flushTargetAddr, if any, since
+// the failed flush is the cause of later failures.
+func (c *StreamConn) checkFlush(err error) error {
+	if flushErr, ok := c.flushErr.Load().(error); ok && err != nil {
+		return flushErr
+	}
+	return err
+}
+
+func (c *StreamConn) Read(b []byte) (int, error) {
+	n, err := c.DuplexConn.Read(b)
+	return n, c.checkFlush(err)
+}
+
+func (c *StreamConn) Write(b []byte) (int, error) {
+	n, err := c.DuplexConn.Write(b)
+	return n, c.checkFlush(err)
+}
+
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return c.DuplexConn.SetDeadline(t)
+}
+
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return c.DuplexConn.SetWriteDeadline(t)
+}
+
+func (c *StreamConn) CloseWrite() error {
+	c.stopKeepAliveOnce.Do(func() { close(c.stopKeepAlive) })
+	return c.DuplexConn.CloseWrite()
+}
+
+func (c *StreamConn) Close() error {
+	c.stopKeepAliveOnce.Do(func() { close(c.stopKeepAlive) })
+	err := c.DuplexConn.Close()
+	if c.observer != nil {
+		c.closeOnce.Do(func() {
+			c.observer.OnClose(c.writer.WireBytes(), atomic.LoadInt64(&c.proxyReader.n))
+		})
+	}
+	return err
+}
+
+// countingReader counts the bytes read from Reader.
+type countingReader struct {
+	// Accessed atomically, so it must be the first field to guarantee 64-bit
+	// alignment on 32-bit platforms.
+	n int64
+	io.Reader
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+// Rekey switches both directions of the connection to `newCipher`, without
+// closing it.  The Reader starts expecting the peer's rekey chunk, and then the
+// Writer sends its own, as described in Writer.Rekey.  When both ends of the
+// connection call Rekey, they exchange rekey chunks and fresh salts, and the
+// rest of the connection uses `newCipher`.  The peer must not send its rekey
+// chunk before Rekey is called on this end, and Rekey must not be called
+// concurrently with writes.  This is an extension to the Shadowsocks protocol,
+// which vanilla Shadowsocks servers don't support.
+func (c *StreamConn) Rekey(newCipher shadowaead.Cipher) error {
+	if err := c.reader.ExpectRekey(newCipher); err != nil {
+		return err
+	}
+	if err := c.writer.Rekey(newCipher); err != nil {
+		return err
+	}
+	c.cipher = newCipher
+	return nil
+}
+
+// RawConn returns the encrypted connection to the proxy, which is a *net.TCPConn.
+// With a TLS client, this is the connection that carries TLS.
+// Reading or writing it directly corrupts the Shadowsocks stream.
+func (c *StreamConn) RawConn() net.Conn {
+	return c.rawConn
+}
+
+// Cipher returns the Shadowsocks cipher used to encrypt the connection.
+func (c *StreamConn) Cipher() shadowaead.Cipher {
+	return c.cipher
+}
+
+// WriteTo and ReadFrom preserve the copy optimizations of the wrapped connection.
+
+func (c *StreamConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, c.DuplexConn)
+	return n, c.checkFlush(err)
+}
+
+func (c *StreamConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(c.DuplexConn, r)
+	return n, c.checkFlush(err)
+}
+
+// dialTCP connects to the proxy and queues the target address, without sending it.
+// Returns the connection that carries the Shadowsocks stream, which uses TLS if
+// configured, and the underlying TCP connection.
+func (c *ssClient) dialTCP(laddr *net.TCPAddr, raddr string) (onet.DuplexConn, *net.TCPConn, *Writer, error) {
+	socksTargetAddr, err := parseTargetAddr(raddr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	proxyAddr := &net.TCPAddr{IP: c.proxyIP, Port: c.proxyPort}
+	deadline := c.dialDeadline()
+	dialer := net.Dialer{Deadline: deadline}
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	if c.tcpFastOpen && tcpFastOpenControl != nil {
+		dialer.Control = tcpFastOpenControl
+	}
+	conn, err := dialer.Dial("tcp", proxyAddr.String())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rawConn := conn.(*net.TCPConn)
+	// Go enables TCP_NODELAY by default, but set it explicitly either way.
+	if err := rawConn.SetNoDelay(c.tcpNoDelay); err != nil {
+		rawConn.Close()
+		return nil, nil, nil, err
+	}
+	var proxyConn onet.DuplexConn = rawConn
+	if c.tlsConfig != nil {
+		tlsConn := tls.Client(rawConn, c.tlsConfig)
+		rawConn.SetDeadline(deadline)
+		if err := tlsConn.Handshake(); err != nil {
+			rawConn.Close()
+			return nil, nil, nil, fmt.Errorf("TLS handshake with proxy failed: %w", err)
+		}
+		rawConn.SetDeadline(time.Time{})
+		proxyConn = &tlsDuplexConn{Conn: tlsConn, rawConn: rawConn}
+	}
 	ssw := NewShadowsocksWriter(proxyConn, c.cipher)
 	_, err = ssw.LazyWrite(socksTargetAddr)
 	if err != nil {
 		proxyConn.Close()
-		return nil, errors.New("Failed to write target address")
+		return nil, nil, nil, errors.New("Failed to write target address")
 	}
-	time.AfterFunc(helloWait, func() {
-		ssw.Flush()
-	})
-	ssr := NewShadowsocksReader(proxyConn, c.cipher)
-	return onet.WrapConn(proxyConn, ssr, ssw), nil
+	return proxyConn, rawConn, ssw, nil
+}
+
+// tlsDuplexConn adds CloseRead to a TLS connection, and makes CloseWrite
+// half-close the underlying connection after the TLS close_notify.
+type tlsDuplexConn struct {
+	*tls.Conn
+	rawConn *net.TCPConn
+}
+
+func (c *tlsDuplexConn) CloseRead() error {
+	return c.rawConn.CloseRead()
+}
+
+func (c *tlsDuplexConn) CloseWrite() error {
+	c.Conn.CloseWrite()
+	return c.rawConn.CloseWrite()
+}
+
+// parseTargetAddr converts `address`, of the form `host:port`, to a SOCKS address.
+// IPv6 hosts must be enclosed in brackets, as in "[2001:db8::1]:53", because an
+// unbracketed address like "2001:db8::1:53" is ambiguous.
+func parseTargetAddr(address string) (socks.Addr, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("Failed to parse target address: %v", err)
+	}
+	socksAddr := socks.ParseAddr(address)
+	if socksAddr == nil {
+		return nil, fmt.Errorf("Failed to parse target address %q", address)
+	}
+	return socksAddr, nil
 }
 
 func (c *ssClient) ListenUDP(laddr *net.UDPAddr) (net.PacketConn, error) {
+	return c.listenUDPContext(context.Background(), laddr)
+}
+
+// ListenUDPContext is like c.ListenUDP, but `ctx` bounds the socket setup.  If `ctx`
+// has a deadline, it becomes the initial read and write deadline of the PacketConn.
+// For clients not created by this package, `ctx` is only checked before the call.
+func ListenUDPContext(ctx context.Context, c Client, laddr *net.UDPAddr) (net.PacketConn, error) {
+	if ssc, ok := c.(*ssClient); ok {
+		return ssc.listenUDPContext(ctx, laddr)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err := c.ListenUDP(laddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+func (c *ssClient) listenUDPContext(ctx context.Context, laddr *net.UDPAddr) (net.PacketConn, error) {
+	release := func() {}
+	if c.udpSlots != nil {
+		select {
+		case c.udpSlots <- struct{}{}:
+		default:
+			return nil, ErrTooManyUDPConns
+		}
+		release = func() { <-c.udpSlots }
+	}
 	proxyAddr := &net.UDPAddr{IP: c.proxyIP, Port: c.proxyPort}
-	pc, err := net.DialUDP("udp", laddr, proxyAddr)
+	var dialer net.Dialer
+	if laddr != nil {
+		// Avoid storing a typed nil in the net.Addr interface.
+		dialer.LocalAddr = laddr
+	}
+	conn, err := dialer.DialContext(ctx, "udp", proxyAddr.String())
 	if err != nil {
+		release()
 		return nil, err
 	}
-	conn := packetConn{UDPConn: pc, cipher: c.cipher}
-	return &conn, nil
+	pc := conn.(*net.UDPConn)
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.SetDeadline(deadline)
+	}
+	ssConn := &packetConn{UDPConn: pc, cipher: c.cipher, batch: newBatchConn(pc, c.proxyIP), bufPool: c.udpBuffers(), release: release}
+	ssConn.proxyAddr.Store(proxyAddr)
+	return ssConn, nil
+}
+
+// PacketConnMetrics holds the traffic counts of a UDP association.
+// Byte counts are payload bytes, excluding the SOCKS address, the salt
+// and the AEAD tag.
+type PacketConnMetrics struct {
+	BytesSent       int64
+	BytesReceived   int64
+	PacketsSent     int64
+	PacketsReceived int64
+}
+
+// Dial connects to `address` though the Shadowsocks proxy of `c`, using c.DialTCP if
+// `network` is "tcp" or c.ListenUDP if it is "udp".  In the UDP case, the returned
+// net.Conn sends every packet to `address`, and reads return the payload of each reply.
+func Dial(c Client, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp":
+		return c.DialTCP(nil, address)
+	case "udp":
+		if _, err := parseTargetAddr(address); err != nil {
+			return nil, err
+		}
+		pc, err := c.ListenUDP(nil)
+		if err != nil {
+			return nil, err
+		}
+		return &udpTargetConn{PacketConn: pc, target: NewAddr(address, "udp")}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported network %q", network)
+	}
+}
+
+// udpTargetConn adapts a PacketConn into a net.Conn that exchanges packets
+// with a single target.
+type udpTargetConn struct {
+	net.PacketConn
+	target net.Addr
+}
+
+func (c *udpTargetConn) Read(b []byte) (int, error) {
+	n, _, err := c.PacketConn.ReadFrom(b)
+	return n, err
+}
+
+func (c *udpTargetConn) Write(b []byte) (int, error) {
+	return c.PacketConn.WriteTo(b, c.target)
+}
+
+// RemoteAddr returns the target address, not the proxy's.
+func (c *udpTargetConn) RemoteAddr() net.Addr {
+	return c.target
 }
 
 type packetConn struct {
+	// Accessed atomically, so it must be the first field to guarantee 64-bit
+	// alignment on 32-bit platforms.
+	metrics PacketConnMetrics
 	*net.UDPConn
 	cipher shadowaead.Cipher
+	batch  batchConn
+	// Source of the buffers for encrypted datagrams.
+	bufPool *sync.Pool
+	// Holds a func(net.Addr), or nil.
+	replyHook atomic.Value
+	// Holds the *net.UDPAddr of the proxy.
+	proxyAddr atomic.Value
+	// Serializes calls to MigrateProxy.
+	migrateMu sync.Mutex
+	// Frees the connection's slot in the client's limit on the first Close.
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *packetConn) Close() error {
+	err := c.UDPConn.Close()
+	c.closeOnce.Do(c.release)
+	return err
+}
+
+// MigrateProxy makes the connection exchange packets with the proxy at
+// `newProxy` instead, for example after the proxy's IP address changes, without
+// closing the socket.  The local address, cipher, deadlines and metrics are
+// kept, and reads that are in progress continue, receiving replies from the new
+// proxy only.  Packets in flight to or from the old proxy are lost, as is any
+// write concurrent with the migration.  `newProxy` must have the same IP
+// family as the current proxy.  This is currently supported on Unix-like
+// systems.
+func (c *packetConn) MigrateProxy(newProxy *net.UDPAddr) error {
+	if newProxy == nil {
+		return errors.New("Missing proxy address")
+	}
+	c.migrateMu.Lock()
+	defer c.migrateMu.Unlock()
+	oldProxy := c.RemoteAddr().(*net.UDPAddr)
+	if (oldProxy.IP.To4() == nil) != (newProxy.IP.To4() == nil) {
+		return fmt.Errorf("Cannot migrate from %v to %v: IP family mismatch", oldProxy, newProxy)
+	}
+	if err := reconnectUDP(c.UDPConn, newProxy); err != nil {
+		return err
+	}
+	c.proxyAddr.Store(newProxy)
+	return nil
+}
+
+// RemoteAddr returns the address of the proxy, following MigrateProxy.
+func (c *packetConn) RemoteAddr() net.Addr {
+	if proxyAddr, ok := c.proxyAddr.Load().(*net.UDPAddr); ok {
+		return proxyAddr
+	}
+	return c.UDPConn.RemoteAddr()
+}
+
+// SetReplyHook makes the connection call `hook` with the source address of each
+// datagram it receives, which helps to diagnose routing and NAT problems.  A nil
+// hook disables it.  The hook runs on the reading goroutine, before the read
+// returns, so it must be fast.
+func (c *packetConn) SetReplyHook(hook func(src net.Addr)) {
+	c.replyHook.Store(hook)
+}
+
+// Metrics returns a snapshot of the traffic counts for this connection.
+func (c *packetConn) Metrics() PacketConnMetrics {
+	return PacketConnMetrics{
+		BytesSent:       atomic.LoadInt64(&c.metrics.BytesSent),
+		BytesReceived:   atomic.LoadInt64(&c.metrics.BytesReceived),
+		PacketsSent:     atomic.LoadInt64(&c.metrics.PacketsSent),
+		PacketsReceived: atomic.LoadInt64(&c.metrics.PacketsReceived),
+	}
+}
+
+// newBuffer retrieves a buffer for an encrypted datagram.
+func (c *packetConn) newBuffer() []byte {
+	return c.bufPool.Get().([]byte)
+}
+
+// freeBuffer returns a buffer obtained from newBuffer.
+func (c *packetConn) freeBuffer(b []byte) {
+	c.bufPool.Put(b)
 }
 
 // WriteTo encrypts `b` and writes to `addr` through the proxy.
 func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	cipherBuf := c.newBuffer()
+	defer c.freeBuffer(cipherBuf)
+	buf, err := c.pack(cipherBuf, b, addr)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.UDPConn.Write(buf)
+	if err == nil {
+		atomic.AddInt64(&c.metrics.BytesSent, int64(len(b)))
+		atomic.AddInt64(&c.metrics.PacketsSent, 1)
+	}
+	return len(b), err
+}
+
+// pack encrypts `b`, addressed to `addr`, into `cipherBuf`, and returns the datagram.
+func (c *packetConn) pack(cipherBuf, b []byte, addr net.Addr) ([]byte, error) {
 	socksTargetAddr := socks.ParseAddr(addr.String())
 	if socksTargetAddr == nil {
-		return 0, errors.New("Failed to parse target address")
+		return nil, errors.New("Failed to parse target address")
 	}
-	cipherBuf := newUDPBuffer()
-	defer freeUDPBuffer(cipherBuf)
 	saltSize := c.cipher.SaltSize()
+	if len(cipherBuf) < saltSize {
+		return nil, io.ErrShortBuffer
+	}
 	// Copy the SOCKS target address and payload, reserving space for the generated salt to avoid
 	// partially overlapping the plaintext and cipher slices since `Pack` skips the salt when calling
 	// `AEAD.Seal` (see https://golang.org/pkg/crypto/cipher/#AEAD).
 	plaintextBuf := append(append(cipherBuf[saltSize:saltSize], socksTargetAddr...), b...)
-	buf, err := shadowaead.Pack(cipherBuf, plaintextBuf, c.cipher)
-	if err != nil {
-		return 0, err
-	}
-	_, err = c.UDPConn.Write(buf)
-	return len(b), err
+	return shadowaead.Pack(cipherBuf, plaintextBuf, c.cipher)
 }
 
 // ReadFrom reads from the embedded PacketConn and decrypts into `b`.
 func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
-	cipherBuf := newUDPBuffer()
-	defer freeUDPBuffer(cipherBuf)
+	cipherBuf := c.newBuffer()
+	defer c.freeBuffer(cipherBuf)
 	n, err := c.UDPConn.Read(cipherBuf)
 	if err != nil {
 		return 0, nil, err
 	}
+	return c.unpack(b, cipherBuf[:n], cipherBuf)
+}
+
+// unpack decrypts the datagram `ciphertext`, which occupies the start of `cipherBuf`,
+// and copies its payload into `b`.
+func (c *packetConn) unpack(b, ciphertext, cipherBuf []byte) (int, net.Addr, error) {
 	// Avoid partially overlapping the plaintext and cipher slices since `Unpack` skips the salt
 	// when calling `AEAD.Open` (see https://golang.org/pkg/crypto/cipher/#AEAD).
-	buf, err := shadowaead.Unpack(cipherBuf[c.cipher.SaltSize():], cipherBuf[:n], c.cipher)
+	if len(cipherBuf) < c.cipher.SaltSize() {
+		return 0, nil, io.ErrShortBuffer
+	}
+	buf, err := shadowaead.Unpack(cipherBuf[c.cipher.SaltSize():], ciphertext, c.cipher)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -137,8 +842,14 @@ func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
 		return 0, nil, errors.New("Failed to read source address")
 	}
 	srcAddr := NewAddr(socksSrcAddr.String(), "udp")
-	n = copy(b, buf[len(socksSrcAddr):]) // Strip the SOCKS source address
-	if len(b) < len(buf)-len(socksSrcAddr) {
+	if hook, _ := c.replyHook.Load().(func(net.Addr)); hook != nil {
+		hook(srcAddr)
+	}
+	payloadSize := len(buf) - len(socksSrcAddr)
+	atomic.AddInt64(&c.metrics.BytesReceived, int64(payloadSize))
+	atomic.AddInt64(&c.metrics.PacketsReceived, 1)
+	n := copy(b, buf[len(socksSrcAddr):]) // Strip the SOCKS source address
+	if len(b) < payloadSize {
 		return n, srcAddr, io.ErrShortBuffer
 	}
 	return n, srcAddr, nil
@@ -163,7 +874,84 @@ func NewAddr(address, network string) net.Addr {
 	return &addr{address: address, network: network}
 }
 
+// cipherCacheKey identifies a derived cipher.  The password is stored as a
+// hash so that the cache doesn't retain it in plaintext.
+type cipherCacheKey struct {
+	cipher       string
+	passwordHash [sha256.Size]byte
+}
+
+// cipherCacheSize is the number of derived ciphers that cipherCache retains.
+const cipherCacheSize = 16
+
+// cipherCache holds the most recently used derived ciphers.  Derived ciphers
+// are immutable, so they can be shared by all clients with the same
+// credentials, sparing each one the cost of the key derivation.  The cache is
+// bounded, so that rotating credentials doesn't keep old keys alive.
+var cipherCache = newCipherLRU(cipherCacheSize)
+
+// cipherLRU is a least-recently-used cache of derived ciphers.
+type cipherLRU struct {
+	mu      sync.Mutex
+	maxSize int
+	// Holds *cipherLRUEntry, the most recently used first.
+	order   *list.List
+	entries map[cipherCacheKey]*list.Element
+}
+
+type cipherLRUEntry struct {
+	key    cipherCacheKey
+	cipher shadowaead.Cipher
+}
+
+func newCipherLRU(maxSize int) *cipherLRU {
+	return &cipherLRU{maxSize: maxSize, order: list.New(), entries: make(map[cipherCacheKey]*list.Element)}
+}
+
+// get returns the cipher for `key`, if cached, and marks it as recently used.
+func (c *cipherLRU) get(key cipherCacheKey) (shadowaead.Cipher, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cipherLRUEntry).cipher, true
+}
+
+// add caches `cipher` for `key`, evicting the least recently used cipher if
+// the cache is full.  If `key` is already cached, add returns the cached
+// cipher instead.
+func (c *cipherLRU) add(key cipherCacheKey, cipher shadowaead.Cipher) shadowaead.Cipher {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return element.Value.(*cipherLRUEntry).cipher
+	}
+	c.entries[key] = c.order.PushFront(&cipherLRUEntry{key: key, cipher: cipher})
+	if c.order.Len() > c.maxSize {
+		oldest := c.order.Remove(c.order.Back()).(*cipherLRUEntry)
+		delete(c.entries, oldest.key)
+	}
+	return cipher
+}
+
 func newAeadCipher(cipher, password string) (shadowaead.Cipher, error) {
+	key := cipherCacheKey{cipher: cipher, passwordHash: sha256.Sum256([]byte(password))}
+	if aead, ok := cipherCache.get(key); ok {
+		return aead, nil
+	}
+	aead, err := pickAeadCipher(cipher, password)
+	if err != nil {
+		return nil, err
+	}
+	// If another goroutine cached an equivalent cipher first, use that one.
+	return cipherCache.add(key, aead), nil
+}
+
+func pickAeadCipher(cipher, password string) (shadowaead.Cipher, error) {
 	ssCipher, err := core.PickCipher(cipher, nil, password)
 	if err != nil {
 		return nil, err
@@ -174,3 +962,40 @@ func newAeadCipher(cipher, password string) (shadowaead.Cipher, error) {
 	}
 	return aead, nil
 }
+
+// supportedCiphers are the conventional names of the AEAD ciphers that
+// newAeadCipher accepts.
+var supportedCiphers = []string{"chacha20-ietf-poly1305", "aes-128-gcm", "aes-192-gcm", "aes-256-gcm"}
+
+// SupportedCiphers returns the names of the supported cipher methods, so that
+// callers can offer them in a configuration UI.
+func SupportedCiphers() []string {
+	return append([]string(nil), supportedCiphers...)
+}
+
+// IsSupportedCipher reports whether `method` names an AEAD cipher that clients
+// accept.  Names are case-insensitive, and the go-shadowsocks2 aliases, like
+// "AEAD_CHACHA20_POLY1305", are also accepted.  Stream ciphers, like "rc4-md5"
+// or "aes-256-cfb", are not supported.
+func IsSupportedCipher(method string) bool {
+	// The key doesn't matter, so any password will do.
+	_, err := pickAeadCipher(method, "")
+	return err == nil
+}
+
+// CipherInfo returns the salt size, nonce size and tag size (i.e. the AEAD
+// overhead per message) of the AEAD cipher `method`, so that callers can size
+// buffers without creating a Reader or Writer.
+func CipherInfo(method string) (saltSize, nonceSize, tagSize int, err error) {
+	// The sizes don't depend on the key, so any password will do.
+	ssCipher, err := pickAeadCipher(method, "")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	saltSize = ssCipher.SaltSize()
+	aead, err := ssCipher.Encrypter(make([]byte, saltSize))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return saltSize, aead.NonceSize(), aead.Overhead(), nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// BatchPacketConn is a net.PacketConn that can also send and receive several
+// datagrams per system call.  The PacketConn returned by Client.ListenUDP
+// implements it.
+//
+// On Linux, batches use sendmmsg and recvmmsg.  On other platforms, they fall
+// back to one datagram per system call, so WriteBatch still sends the whole
+// batch, but ReadBatch returns at most one datagram.
+type BatchPacketConn interface {
+	net.PacketConn
+	// WriteBatch encrypts each payload and sends it to the corresponding address,
+	// through the proxy.  It returns the number of datagrams sent, which is less
+	// than len(payloads) only if there is an error.
+	WriteBatch(payloads [][]byte, addrs []net.Addr) (int, error)
+	// ReadBatch receives up to len(buffers) datagrams, decrypting the payload of
+	// each into the corresponding buffer.  It returns the number of datagrams read,
+	// with the payload size and source address of each.  If a datagram cannot be
+	// decrypted, ReadBatch returns the datagrams before it along with the error,
+	// and drops the rest of the batch.
+	ReadBatch(buffers [][]byte) (n int, sizes []int, addrs []net.Addr, err error)
+}
+
+// batchConn sends and receives the datagrams of a connected UDP socket, several
+// per system call where the platform allows it.  See newBatchConn.
+type batchConn interface {
+	// WriteBatch sends each of `bufs` as a datagram, and returns the number sent.
+	WriteBatch(bufs [][]byte) (int, error)
+	// ReadBatch receives up to len(bufs) datagrams into `bufs`, and returns the
+	// number received.  It stores the size of each datagram in `sizes`.
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+}
+
+func (c *packetConn) WriteBatch(payloads [][]byte, addrs []net.Addr) (int, error) {
+	if len(payloads) != len(addrs) {
+		return 0, errors.New("Mismatched number of payloads and addresses")
+	}
+	bufs := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		cipherBuf := c.newBuffer()
+		defer c.freeBuffer(cipherBuf)
+		buf, err := c.pack(cipherBuf, payload, addrs[i])
+		if err != nil {
+			return 0, err
+		}
+		bufs[i] = buf
+	}
+	sent := 0
+	for sent < len(bufs) {
+		n, err := c.batch.WriteBatch(bufs[sent:])
+		for _, payload := range payloads[sent : sent+n] {
+			atomic.AddInt64(&c.metrics.BytesSent, int64(len(payload)))
+		}
+		atomic.AddInt64(&c.metrics.PacketsSent, int64(n))
+		sent += n
+		if err == nil && n == 0 {
+			// Retrying would spin forever.
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+func (c *packetConn) ReadBatch(buffers [][]byte) (int, []int, []net.Addr, error) {
+	cipherBufs := make([][]byte, len(buffers))
+	for i := range cipherBufs {
+		cipherBuf := c.newBuffer()
+		defer c.freeBuffer(cipherBuf)
+		cipherBufs[i] = cipherBuf
+	}
+	cipherSizes := make([]int, len(buffers))
+	n, err := c.batch.ReadBatch(cipherBufs, cipherSizes)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	sizes := make([]int, n)
+	addrs := make([]net.Addr, n)
+	for i, cipherBuf := range cipherBufs[:n] {
+		sizes[i], addrs[i], err = c.unpack(buffers[i], cipherBuf[:cipherSizes[i]], cipherBuf)
+		if err != nil {
+			return i, sizes[:i], addrs[:i], err
+		}
+	}
+	return n, sizes, addrs, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ipBatchConn is a batchConn that uses sendmmsg and recvmmsg, through
+// *ipv4.PacketConn or *ipv6.PacketConn, which share the Message type.
+type ipBatchConn struct {
+	conn interface {
+		WriteBatch(ms []ipv4.Message, flags int) (int, error)
+		ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+}
+
+func newBatchConn(conn *net.UDPConn, proxyIP net.IP) batchConn {
+	if proxyIP.To4() != nil {
+		return &ipBatchConn{conn: ipv4.NewPacketConn(conn)}
+	}
+	return &ipBatchConn{conn: ipv6.NewPacketConn(conn)}
+}
+
+func (c *ipBatchConn) WriteBatch(bufs [][]byte) (int, error) {
+	msgs := make([]ipv4.Message, len(bufs))
+	for i, buf := range bufs {
+		msgs[i].Buffers = [][]byte{buf}
+	}
+	return c.conn.WriteBatch(msgs, 0)
+}
+
+func (c *ipBatchConn) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	msgs := make([]ipv4.Message, len(bufs))
+	for i, buf := range bufs {
+		msgs[i].Buffers = [][]byte{buf}
+	}
+	n, err := c.conn.ReadBatch(msgs, 0)
+	for i, msg := range msgs[:n] {
+		sizes[i] = msg.N
+	}
+	return n, err
+}
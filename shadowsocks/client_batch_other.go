@@ -0,0 +1,52 @@
+//go:build !linux
+// +build !linux
+
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import "net"
+
+// singleBatchConn is a batchConn that sends and receives one datagram per system
+// call.  golang.org/x/net/ipv4 would do the same on these platforms, but it
+// doesn't link on darwin with current toolchains.
+type singleBatchConn struct {
+	conn *net.UDPConn
+}
+
+func newBatchConn(conn *net.UDPConn, proxyIP net.IP) batchConn {
+	return singleBatchConn{conn: conn}
+}
+
+func (c singleBatchConn) WriteBatch(bufs [][]byte) (int, error) {
+	for i, buf := range bufs {
+		if _, err := c.conn.Write(buf); err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
+
+func (c singleBatchConn) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+	n, err := c.conn.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShadowsocksClient_Batch(t *testing.T) {
+	proxy, running := startShadowsocksUDPEchoServer(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	pc, err := d.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.ListenUDP failed: %v", err)
+	}
+	defer pc.Close()
+	conn := pc.(BatchPacketConn)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	targetAddr := NewAddr(testTargetAddr, "udp")
+	payloads := [][]byte{MakeTestPayload(10), MakeTestPayload(200), MakeTestPayload(1000)}
+	n, err := conn.WriteBatch(payloads, []net.Addr{targetAddr, targetAddr, targetAddr})
+	if err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	if n != len(payloads) {
+		t.Fatalf("WriteBatch sent %d of %d datagrams", n, len(payloads))
+	}
+
+	// The echoes may arrive across several batches.
+	var received [][]byte
+	for len(received) < len(payloads) {
+		buffers := make([][]byte, len(payloads)-len(received))
+		for i := range buffers {
+			buffers[i] = make([]byte, 1024)
+		}
+		n, sizes, addrs, err := conn.ReadBatch(buffers)
+		if err != nil {
+			t.Fatalf("ReadBatch failed: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			if addrs[i].String() != testTargetAddr {
+				t.Errorf("Wrong source address %v", addrs[i])
+			}
+			received = append(received, buffers[i][:sizes[i]])
+		}
+	}
+	for i, payload := range payloads {
+		if !bytes.Equal(received[i], payload) {
+			t.Errorf("Wrong echo for datagram %d", i)
+		}
+	}
+	metrics := pc.(*packetConn).Metrics()
+	if metrics.PacketsSent != 3 || metrics.BytesSent != 1210 {
+		t.Errorf("Wrong send metrics: %+v", metrics)
+	}
+	if metrics.PacketsReceived != 3 || metrics.BytesReceived != 1210 {
+		t.Errorf("Wrong receive metrics: %+v", metrics)
+	}
+
+	proxy.Close()
+	running.Wait()
+}
+
+func TestShadowsocksClient_WriteBatchMismatch(t *testing.T) {
+	d, err := NewClient("127.0.0.1", 1, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	pc, err := d.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.ListenUDP failed: %v", err)
+	}
+	defer pc.Close()
+	if _, err := pc.(BatchPacketConn).WriteBatch([][]byte{{1}}, nil); err == nil {
+		t.Error("Expected an error for mismatched payloads and addresses")
+	}
+}
+
+// stalledBatchConn is a batchConn whose writes make no progress.
+type stalledBatchConn struct{}
+
+func (stalledBatchConn) WriteBatch(bufs [][]byte) (int, error) {
+	return 0, nil
+}
+
+func (stalledBatchConn) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	return 0, nil
+}
+
+func TestPacketConn_WriteBatchNoProgress(t *testing.T) {
+	cipher, err := newAeadCipher(testCipher, testPassword)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	c := &packetConn{cipher: cipher, batch: stalledBatchConn{}, bufPool: pool}
+	addr := NewAddr(testTargetAddr, "udp")
+	n, err := c.WriteBatch([][]byte{{1}, {2}}, []net.Addr{addr, addr})
+	if err != io.ErrShortWrite {
+		t.Errorf("Expected io.ErrShortWrite, got %v", err)
+	}
+	if n != 0 {
+		t.Errorf("Expected no datagrams sent, got %v", n)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShadowsocksClient_TCPFastOpen(t *testing.T) {
+	proxy, running := startShadowsocksTCPEchoProxy(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher, WithTCPFastOpen(true))
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	// The first connection gets a cookie, if the kernel allows it, and the
+	// second one can use it.
+	for i := 0; i < 2; i++ {
+		payload := MakeTestPayload(100)
+		conn, err := DialTCPWithPayload(d, nil, testTargetAddr, payload)
+		if err != nil {
+			t.Fatalf("DialTCPWithPayload failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		echo := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, echo); err != nil {
+			t.Fatalf("Failed to read echo: %v", err)
+		}
+		if !bytes.Equal(echo, payload) {
+			t.Error("Echo mismatch")
+		}
+
+		rawConn, err := conn.(*StreamConn).RawConn().(syscall.Conn).SyscallConn()
+		if err != nil {
+			t.Fatalf("SyscallConn failed: %v", err)
+		}
+		var value int
+		var sockErr error
+		rawConn.Control(func(fd uintptr) {
+			value, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect)
+		})
+		if sockErr == nil && value != 1 {
+			t.Errorf("TCP_FASTOPEN_CONNECT is %d", value)
+		}
+		conn.Close()
+	}
+
+	proxy.Close()
+	running.Wait()
+}
+
+// getsockoptTCP returns the value of the TCP-level socket option `opt` on the
+// proxy connection of `conn`.
+func getsockoptTCP(t *testing.T, conn *StreamConn, opt int) int {
+	rawConn, err := conn.RawConn().(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var value int
+	var sockErr error
+	rawConn.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt)
+	})
+	if sockErr != nil {
+		t.Fatalf("getsockopt failed: %v", sockErr)
+	}
+	return value
+}
+
+func TestShadowsocksClient_TCPNoDelay(t *testing.T) {
+	proxy, running := startShadowsocksTCPEchoProxy(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	for _, noDelay := range []bool{true, false} {
+		d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher, WithTCPNoDelay(noDelay))
+		if err != nil {
+			t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+		}
+		conn, err := d.DialTCP(nil, testTargetAddr)
+		if err != nil {
+			t.Fatalf("ShadowsocksClient.DialTCP failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		expectEchoPayload(conn, MakeTestPayload(10), make([]byte, 10), t)
+		value := getsockoptTCP(t, conn.(*StreamConn), syscall.TCP_NODELAY)
+		if (value != 0) != noDelay {
+			t.Errorf("TCP_NODELAY is %d, expected %v", value, noDelay)
+		}
+		conn.Close()
+	}
+
+	proxy.Close()
+	running.Wait()
+}
+
+func TestShadowsocksClient_ListenUDPMigrateProxy(t *testing.T) {
+	oldProxy, oldRunning := startShadowsocksUDPEchoServer(testTargetAddr, t)
+	newProxy, newRunning := startShadowsocksUDPEchoServer(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(oldProxy.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn, err := d.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.ListenUDP failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	pcrw := &packetConnReadWriter{PacketConn: conn, targetAddr: NewAddr(testTargetAddr, "udp")}
+	expectEchoPayload(pcrw, MakeTestPayload(100), make([]byte, 100), t)
+
+	newProxyAddr := newProxy.LocalAddr().(*net.UDPAddr)
+	if err := conn.(*packetConn).MigrateProxy(newProxyAddr); err != nil {
+		t.Fatalf("MigrateProxy failed: %v", err)
+	}
+	if conn.(*packetConn).RemoteAddr() != newProxyAddr {
+		t.Errorf("Expected remote address %v, got %v", newProxyAddr, conn.(*packetConn).RemoteAddr())
+	}
+	// Only the new proxy can echo from now on.
+	oldProxy.Close()
+	oldRunning.Wait()
+	expectEchoPayload(pcrw, MakeTestPayload(100), make([]byte, 100), t)
+
+	if err := conn.(*packetConn).MigrateProxy(&net.UDPAddr{IP: net.IPv6loopback, Port: 1}); err == nil {
+		t.Error("Expected an error for a proxy with a different IP family")
+	}
+
+	newProxy.Close()
+	newRunning.Wait()
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"net"
+	"syscall"
+)
+
+// reconnectUDP connects the already-connected socket of `conn` to `raddr`,
+// which replaces its peer in place.  The local address is kept.
+func reconnectUDP(conn *net.UDPConn, raddr *net.UDPAddr) error {
+	var sa syscall.Sockaddr
+	if ip4 := raddr.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: raddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: raddr.Port}
+		copy(sa6.Addr[:], raddr.IP.To16())
+		sa = sa6
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var connectErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		connectErr = syscall.Connect(int(fd), sa)
+	}); err != nil {
+		return err
+	}
+	return connectErr
+}
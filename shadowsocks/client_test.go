@@ -2,8 +2,19 @@ package shadowsocks
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"strconv"
 	"sync"
@@ -67,6 +78,473 @@ func TestShadowsocksClient_DialTCPNoPayload(t *testing.T) {
 	running.Wait()
 }
 
+func TestShadowsocksClient_DialTCPStreamConn(t *testing.T) {
+	proxy, running := startShadowsocksTCPEchoProxy(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn, err := d.DialTCP(nil, testTargetAddr)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.DialTCP failed: %v", err)
+	}
+	streamConn, ok := conn.(*StreamConn)
+	if !ok {
+		t.Fatalf("DialTCP returned %T, not *StreamConn", conn)
+	}
+	rawConn, ok := streamConn.RawConn().(*net.TCPConn)
+	if !ok {
+		t.Fatalf("RawConn returned %T, not *net.TCPConn", streamConn.RawConn())
+	}
+	if err := rawConn.SetNoDelay(true); err != nil {
+		t.Errorf("SetNoDelay failed: %v", err)
+	}
+	if rawConn.RemoteAddr().String() != proxy.Addr().String() {
+		t.Errorf("RawConn is connected to %v, not the proxy", rawConn.RemoteAddr())
+	}
+	if streamConn.Cipher() != d.(*ssClient).cipher {
+		t.Error("Cipher does not match the client's cipher")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	expectEchoPayload(conn, MakeTestPayload(1024), make([]byte, 1024), t)
+	conn.Close()
+
+	proxy.Close()
+	running.Wait()
+}
+
+func TestShadowsocksClient_DialTCPOverTLS(t *testing.T) {
+	serverConfig, clientConfig := makeTestTLSConfigs(t)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer listener.Close()
+	cipher, err := newAeadCipher(testCipher, testPassword)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	// Terminate TLS, then echo the Shadowsocks stream.
+	done := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		tlsConn := tls.Server(conn, serverConfig)
+		ssr := NewShadowsocksReader(tlsConn, cipher)
+		ssw := NewShadowsocksWriter(tlsConn, cipher)
+		tgtHost, tgtPort, err := ReadTargetAddress(ssr)
+		if err != nil {
+			done <- err
+			return
+		}
+		if tgtAddr := net.JoinHostPort(tgtHost, strconv.Itoa(tgtPort)); tgtAddr != testTargetAddr {
+			done <- fmt.Errorf("Expected target address '%v'. Got '%v'", testTargetAddr, tgtAddr)
+			return
+		}
+		_, err = io.Copy(ssw, ssr)
+		done <- err
+	}()
+
+	proxyHost, proxyPort, err := splitHostPortNumber(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClientWithCipher(proxyHost, proxyPort, cipher, WithTLS(clientConfig))
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn, err := d.DialTCP(nil, testTargetAddr)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.DialTCP failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	expectEchoPayload(conn, MakeTestPayload(1024), make([]byte, 1024), t)
+	if err := conn.CloseWrite(); err != nil {
+		t.Errorf("CloseWrite failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Proxy failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestShadowsocksClient_DialTCPOverTLSUntrusted(t *testing.T) {
+	serverConfig, _ := makeTestTLSConfigs(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	proxyHost, proxyPort, err := splitHostPortNumber(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	// The default configuration doesn't trust the self-signed certificate.
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher, WithTLS(&tls.Config{ServerName: "proxy.test"}))
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	if _, err := d.DialTCP(nil, testTargetAddr); err == nil {
+		t.Error("Expected the TLS handshake to fail")
+	}
+}
+
+func TestShadowsocksClient_DialTimeoutTLS(t *testing.T) {
+	// The proxy accepts connections, but never completes the TLS handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	proxyHost, proxyPort, err := splitHostPortNumber(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher, WithTLS(&tls.Config{ServerName: "proxy.test"}), WithDialTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	start := time.Now()
+	_, err = d.DialTCP(nil, testTargetAddr)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Dial took %v", elapsed)
+	}
+}
+
+func TestShadowsocksClient_DialTimeoutPayload(t *testing.T) {
+	// The proxy accepts connections, but never reads.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	proxyHost, proxyPort, err := splitHostPortNumber(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher, WithDialTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	// Much larger than the socket buffers, so the write blocks.
+	_, err = DialTCPWithPayload(d, nil, testTargetAddr, make([]byte, 32<<20))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	(<-accepted).Close()
+}
+
+func TestShadowsocksClient_DialTimeoutTargetAddr(t *testing.T) {
+	// The proxy accepts connections, but never reads.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	proxyHost, proxyPort, err := splitHostPortNumber(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	c := d.(*ssClient)
+	proxyConn, rawConn, ssw, err := c.dialTCP(nil, testTargetAddr)
+	if err != nil {
+		t.Fatalf("dialTCP failed: %v", err)
+	}
+	defer (<-accepted).Close()
+	conn := c.newStreamConn(proxyConn, rawConn, ssw)
+	// Fill the socket buffers, so that the address write blocks.  The kernel
+	// accepts small writes after a large one blocks, so finish with single bytes.
+	for _, size := range []int{1 << 16, 1} {
+		for {
+			rawConn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+			if _, err := rawConn.Write(make([]byte, size)); err != nil {
+				break
+			}
+		}
+	}
+	rawConn.SetWriteDeadline(time.Time{})
+
+	conn.flushTargetAddr(100 * time.Millisecond)
+	_, err = conn.Read(make([]byte, 10))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if _, err := conn.Write([]byte{1}); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
+
+// makeTestTLSConfigs returns a server configuration with a self-signed certificate
+// for "proxy.test", and a client configuration that trusts it.
+func makeTestTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy.test"},
+		DNSNames:     []string{"proxy.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: roots, ServerName: "proxy.test"}
+	return server, client
+}
+
+func TestShadowsocksClient_IdleKeepAlive(t *testing.T) {
+	proxy, running := startShadowsocksTCPEchoProxy(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher, WithIdleKeepAlive(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn, err := d.DialTCP(nil, testTargetAddr)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.DialTCP failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	expectEchoPayload(conn, MakeTestPayload(100), make([]byte, 100), t)
+
+	writer := conn.(*StreamConn).writer
+	wireBytes := writer.WireBytes()
+	time.Sleep(100 * time.Millisecond)
+	if writer.WireBytes() == wireBytes {
+		t.Error("No keepalive was sent while idle")
+	}
+	// The keepalives are invisible to the target.
+	expectEchoPayload(conn, MakeTestPayload(100), make([]byte, 100), t)
+	conn.Close()
+
+	proxy.Close()
+	running.Wait()
+}
+
+// recordingObserver records the events reported to a ClientObserver.
+type recordingObserver struct {
+	mu        sync.Mutex
+	starts    int
+	dialErrs  []error
+	closes    int
+	bytesUp   int64
+	bytesDown int64
+}
+
+func (o *recordingObserver) OnDialStart() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.starts++
+}
+
+func (o *recordingObserver) OnDialEnd(err error, duration time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.dialErrs = append(o.dialErrs, err)
+}
+
+func (o *recordingObserver) OnClose(bytesUp, bytesDown int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closes++
+	o.bytesUp = bytesUp
+	o.bytesDown = bytesDown
+}
+
+func TestShadowsocksClient_Observer(t *testing.T) {
+	proxy, running := startShadowsocksTCPEchoProxy(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	observer := &recordingObserver{}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher, WithObserver(observer))
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn, err := DialTCPWithPayload(d, nil, testTargetAddr, MakeTestPayload(100))
+	if err != nil {
+		t.Fatalf("DialTCPWithPayload failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadFull(conn, make([]byte, 100)); err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	conn.Close()
+	conn.Close()
+	proxy.Close()
+	running.Wait()
+
+	observer.mu.Lock()
+	if observer.starts != 1 || len(observer.dialErrs) != 1 || observer.dialErrs[0] != nil {
+		t.Errorf("Expected one successful dial, got %d starts and results %v", observer.starts, observer.dialErrs)
+	}
+	if observer.closes != 1 {
+		t.Errorf("Expected one close, got %d", observer.closes)
+	}
+	// The echo has the same size as the request, apart from the target address.
+	if observer.bytesUp < 100 || observer.bytesDown < 100 {
+		t.Errorf("Byte counts are too small: %d up, %d down", observer.bytesUp, observer.bytesDown)
+	}
+	observer.dialErrs = nil
+	observer.mu.Unlock()
+
+	// A failed dial is reported, and there is no connection to close.
+	d, err = NewClient("127.0.0.1", 1, testPassword, testCipher, WithObserver(observer))
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	if _, err := d.DialTCP(nil, testTargetAddr); err == nil {
+		t.Fatal("Expected dial to fail")
+	}
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if len(observer.dialErrs) != 1 || observer.dialErrs[0] == nil {
+		t.Errorf("Expected one failed dial, got results %v", observer.dialErrs)
+	}
+}
+
+func TestShadowsocksClient_DialTCPWithPayload(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer listener.Close()
+	proxyHost, proxyPort, err := splitHostPortNumber(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	payload := MakeTestPayload(100)
+	conn, err := DialTCPWithPayload(d, nil, testTargetAddr, payload)
+	if err != nil {
+		t.Fatalf("DialTCPWithPayload failed: %v", err)
+	}
+	defer conn.Close()
+
+	proxyConn, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatalf("AcceptTCP failed: %v", err)
+	}
+	defer proxyConn.Close()
+	proxyConn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	cipher, err := newAeadCipher(testCipher, testPassword)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	cr := &chunkReader{reader: proxyConn, ssCipher: cipher}
+	chunk, err := cr.ReadChunk()
+	if err != nil {
+		t.Fatalf("ReadChunk failed: %v", err)
+	}
+	expected := append(socks.ParseAddr(testTargetAddr), payload...)
+	if !bytes.Equal(chunk, expected) {
+		t.Errorf("First chunk should contain the target address and payload. Got %v", chunk)
+	}
+}
+
+func TestDialTCPWithPayload_OtherClient(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer listener.Close()
+	proxyHost, proxyPort, err := splitHostPortNumber(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	payload := MakeTestPayload(100)
+	conn, err := DialTCPWithPayload(wrappedClient{d}, nil, testTargetAddr, payload)
+	if err != nil {
+		t.Fatalf("DialTCPWithPayload failed: %v", err)
+	}
+	defer conn.Close()
+
+	proxyConn, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatalf("AcceptTCP failed: %v", err)
+	}
+	defer proxyConn.Close()
+	proxyConn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	cipher, err := newAeadCipher(testCipher, testPassword)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	// The payload follows the target address, possibly in another chunk.
+	expected := append(socks.ParseAddr(testTargetAddr), payload...)
+	received := make([]byte, len(expected))
+	if _, err := io.ReadFull(NewShadowsocksReader(proxyConn, cipher), received); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(received, expected) {
+		t.Errorf("Expected the target address and payload. Got %v", received)
+	}
+}
+
 func TestShadowsocksClient_DialTCPFastClose(t *testing.T) {
 	// Set up a listener that verifies no data is sent.
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
@@ -112,6 +590,64 @@ func TestShadowsocksClient_DialTCPFastClose(t *testing.T) {
 	<-done
 }
 
+func TestStreamConn_Rekey(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer listener.Close()
+	rawLeft, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	rawRight, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatalf("AcceptTCP failed: %v", err)
+	}
+	c := &ssClient{cipher: newTestCipher(t)}
+	left := c.newStreamConn(rawLeft, rawLeft, NewShadowsocksWriter(rawLeft, c.cipher))
+	defer left.Close()
+	right := c.newStreamConn(rawRight, rawRight, NewShadowsocksWriter(rawRight, c.cipher))
+	defer right.Close()
+	expectMessage := func(conn *StreamConn, expected string) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if string(buf) != expected {
+			t.Errorf("Expected %q, got %q", expected, buf)
+		}
+	}
+
+	if _, err := left.Write([]byte("before")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	expectMessage(right, "before")
+	newCipher, err := shadowaead.AESGCM([]byte("1234567890123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both ends rekey before reading the other's rekey chunk.
+	if err := left.Rekey(newCipher); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if err := right.Rekey(newCipher); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if _, err := left.Write([]byte("after")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	expectMessage(right, "after")
+	if _, err := right.Write([]byte("reply")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	expectMessage(left, "reply")
+	if left.Cipher() != newCipher {
+		t.Error("Cipher was not updated")
+	}
+}
+
 func TestShadowsocksClient_ListenUDP(t *testing.T) {
 	proxy, running := startShadowsocksUDPEchoServer(testTargetAddr, t)
 	proxyHost, proxyPort, err := splitHostPortNumber(proxy.LocalAddr().String())
@@ -135,6 +671,388 @@ func TestShadowsocksClient_ListenUDP(t *testing.T) {
 	running.Wait()
 }
 
+func TestShadowsocksClient_UDPBufferSize(t *testing.T) {
+	proxy, running := startShadowsocksUDPEchoServer(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	const payloadSize = 30000
+	targetAddr := NewAddr(testTargetAddr, "udp")
+	conn, err := d.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.ListenUDP failed: %v", err)
+	}
+	if _, err := conn.WriteTo(MakeTestPayload(payloadSize), targetAddr); err == nil {
+		t.Error("Expected the default buffer to be too small")
+	}
+	conn.Close()
+
+	for _, size := range []int{-1, 16, minUDPBufferSize - 1, maxUDPPayloadSize + 1} {
+		if _, err := NewClient(proxyHost, proxyPort, testPassword, testCipher, WithUDPBufferSize(size)); err == nil {
+			t.Errorf("Expected an error for buffer size %v", size)
+		}
+	}
+	d, err = NewClient(proxyHost, proxyPort, testPassword, testCipher, WithUDPBufferSize(maxUDPPayloadSize))
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn, err = d.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.ListenUDP failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	pcrw := &packetConnReadWriter{PacketConn: conn, targetAddr: targetAddr}
+	expectEchoPayload(pcrw, MakeTestPayload(payloadSize), make([]byte, payloadSize), t)
+
+	proxy.Close()
+	running.Wait()
+}
+
+func TestPacketConn_ShortBuffer(t *testing.T) {
+	cipher, err := newAeadCipher(testCipher, testPassword)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	c := &packetConn{cipher: cipher}
+	// Smaller than the salt.
+	cipherBuf := make([]byte, 16)
+	if _, err := c.pack(cipherBuf, []byte{1}, NewAddr(testTargetAddr, "udp")); err != io.ErrShortBuffer {
+		t.Errorf("Expected io.ErrShortBuffer from pack, got %v", err)
+	}
+	if _, _, err := c.unpack(make([]byte, 1), cipherBuf, cipherBuf); err != io.ErrShortBuffer {
+		t.Errorf("Expected io.ErrShortBuffer from unpack, got %v", err)
+	}
+}
+
+func TestShadowsocksClient_MaxUDPConns(t *testing.T) {
+	d, err := NewClient("127.0.0.1", 1, testPassword, testCipher, WithMaxUDPConns(2))
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn1, err := d.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.ListenUDP failed: %v", err)
+	}
+	conn2, err := Dial(d, "udp", testTargetAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn2.Close()
+	if _, err := d.ListenUDP(nil); !errors.Is(err, ErrTooManyUDPConns) {
+		t.Fatalf("Expected ErrTooManyUDPConns, got %v", err)
+	}
+
+	// Closing twice only frees one slot.
+	conn1.Close()
+	conn1.Close()
+	conn3, err := d.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.ListenUDP failed after Close: %v", err)
+	}
+	defer conn3.Close()
+	if _, err := d.ListenUDP(nil); !errors.Is(err, ErrTooManyUDPConns) {
+		t.Errorf("Expected ErrTooManyUDPConns, got %v", err)
+	}
+}
+
+// wrappedClient hides the implementation of a Client, like an external
+// implementation or mock would.
+type wrappedClient struct {
+	Client
+}
+
+func TestShadowsocksClient_ListenUDPContext(t *testing.T) {
+	d, err := NewClient("127.0.0.1", 1, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+
+	for _, client := range []Client{d, wrappedClient{d}} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := ListenUDPContext(ctx, client, nil); err == nil {
+			t.Errorf("%T: Expected an error with a canceled context", client)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		conn, err := ListenUDPContext(ctx, client, nil)
+		if err != nil {
+			t.Fatalf("%T: ListenUDPContext failed: %v", client, err)
+		}
+		defer conn.Close()
+		// Nothing is listening, so the read only ends at the context deadline.
+		_, _, err = conn.ReadFrom(make([]byte, 10))
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("%T: Expected a timeout error, got %v", client, err)
+		}
+	}
+}
+
+func TestShadowsocksClient_ListenUDPMetrics(t *testing.T) {
+	proxy, running := startShadowsocksUDPEchoServer(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn, err := d.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.ListenUDP failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	pcrw := &packetConnReadWriter{PacketConn: conn, targetAddr: NewAddr(testTargetAddr, "udp")}
+	const numPackets = 5
+	const payloadSize = 100
+	for i := 0; i < numPackets; i++ {
+		expectEchoPayload(pcrw, MakeTestPayload(payloadSize), make([]byte, payloadSize), t)
+	}
+
+	expected := PacketConnMetrics{
+		BytesSent:       numPackets * payloadSize,
+		BytesReceived:   numPackets * payloadSize,
+		PacketsSent:     numPackets,
+		PacketsReceived: numPackets,
+	}
+	if m := conn.(*packetConn).Metrics(); m != expected {
+		t.Errorf("Expected metrics %+v. Got %+v", expected, m)
+	}
+
+	proxy.Close()
+	running.Wait()
+}
+
+func TestShadowsocksClient_ListenUDPReplyHook(t *testing.T) {
+	proxy, running := startShadowsocksUDPEchoServer(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn, err := d.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.ListenUDP failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var replies []string
+	conn.(*packetConn).SetReplyHook(func(src net.Addr) {
+		replies = append(replies, src.String())
+	})
+	pcrw := &packetConnReadWriter{PacketConn: conn, targetAddr: NewAddr(testTargetAddr, "udp")}
+	expectEchoPayload(pcrw, MakeTestPayload(100), make([]byte, 100), t)
+	if len(replies) != 1 || replies[0] != testTargetAddr {
+		t.Errorf("Unexpected replies %v", replies)
+	}
+
+	// A nil hook is disabled.
+	conn.(*packetConn).SetReplyHook(nil)
+	expectEchoPayload(pcrw, MakeTestPayload(100), make([]byte, 100), t)
+	if len(replies) != 1 {
+		t.Errorf("Hook was called after it was removed")
+	}
+
+	proxy.Close()
+	running.Wait()
+}
+
+func TestShadowsocksClient_Dial(t *testing.T) {
+	tcpProxy, tcpRunning := startShadowsocksTCPEchoProxy(testTargetAddr, t)
+	udpProxy, udpRunning := startShadowsocksUDPEchoServer(testTargetAddr, t)
+	for _, tc := range []struct {
+		network string
+		proxy   net.Addr
+	}{
+		{"tcp", tcpProxy.Addr()},
+		{"udp", udpProxy.LocalAddr()},
+	} {
+		proxyHost, proxyPort, err := splitHostPortNumber(tc.proxy.String())
+		if err != nil {
+			t.Fatalf("Failed to parse proxy address: %v", err)
+		}
+		d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+		if err != nil {
+			t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+		}
+		for _, client := range []Client{d, wrappedClient{d}} {
+			conn, err := Dial(client, tc.network, testTargetAddr)
+			if err != nil {
+				t.Fatalf("%T: Dial(%v) failed: %v", client, tc.network, err)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			expectEchoPayload(conn, MakeTestPayload(1024), make([]byte, 1024), t)
+			conn.Close()
+		}
+	}
+	tcpProxy.Close()
+	tcpRunning.Wait()
+	udpProxy.Close()
+	udpRunning.Wait()
+}
+
+func TestShadowsocksClient_DialUDPIPv6(t *testing.T) {
+	const ipv6TargetAddr = "[::1]:53"
+	proxy, running := startShadowsocksUDPEchoServer(ipv6TargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn, err := Dial(d, "udp", ipv6TargetAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	expectEchoPayload(conn, MakeTestPayload(1024), make([]byte, 1024), t)
+	conn.Close()
+
+	// An unbracketed IPv6 address is ambiguous.
+	if _, err := Dial(d, "udp", "2001:db8::1:53"); err == nil {
+		t.Error("Expected an error for an unbracketed IPv6 address")
+	}
+	proxy.Close()
+	running.Wait()
+}
+
+func TestShadowsocksClient_DialUnsupported(t *testing.T) {
+	d, err := NewClient("127.0.0.1", 1, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	if _, err := Dial(d, "sctp", testTargetAddr); err == nil {
+		t.Error("Expected an error for an unsupported network")
+	}
+	if _, err := Dial(d, "udp", "no port"); err == nil {
+		t.Error("Expected an error for an invalid address")
+	}
+}
+
+func TestNewClientSharesCipher(t *testing.T) {
+	c1, err := NewClient("127.0.0.1", 1, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	c2, err := NewClient("127.0.0.1", 2, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	if c1.(*ssClient).cipher != c2.(*ssClient).cipher {
+		t.Error("Clients with the same credentials should share the cipher")
+	}
+	c3, err := NewClient("127.0.0.1", 1, "otherPassword", testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	if c1.(*ssClient).cipher == c3.(*ssClient).cipher {
+		t.Error("Clients with different passwords should not share the cipher")
+	}
+}
+
+func TestCipherLRU(t *testing.T) {
+	cache := newCipherLRU(2)
+	keys := make([]cipherCacheKey, 3)
+	ciphers := make([]shadowaead.Cipher, 3)
+	for i := range keys {
+		keys[i] = cipherCacheKey{cipher: testCipher, passwordHash: sha256.Sum256([]byte{byte(i)})}
+		var err error
+		if ciphers[i], err = pickAeadCipher(testCipher, string([]byte{byte(i)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache.add(keys[0], ciphers[0])
+	cache.add(keys[1], ciphers[1])
+	// Using the first cipher makes the second one the least recently used.
+	if cipher, ok := cache.get(keys[0]); !ok || cipher != ciphers[0] {
+		t.Error("Expected the first cipher to be cached")
+	}
+	cache.add(keys[2], ciphers[2])
+	if _, ok := cache.get(keys[1]); ok {
+		t.Error("Expected the second cipher to be evicted")
+	}
+	if cipher, ok := cache.get(keys[2]); !ok || cipher != ciphers[2] {
+		t.Error("Expected the third cipher to be cached")
+	}
+	// Adding an existing key keeps the cached cipher.
+	if cipher := cache.add(keys[0], ciphers[2]); cipher != ciphers[0] {
+		t.Error("Expected add to return the cached cipher")
+	}
+	if len(cache.entries) != 2 || cache.order.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d and %d", len(cache.entries), cache.order.Len())
+	}
+}
+
+func TestShadowsocksClient_NewClientWithCipher(t *testing.T) {
+	proxy, running := startShadowsocksTCPEchoProxy(testTargetAddr, t)
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	cipher, err := newAeadCipher(testCipher, testPassword)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	d, err := NewClientWithCipher(proxyHost, proxyPort, cipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	conn, err := d.DialTCP(nil, testTargetAddr)
+	if err != nil {
+		t.Fatalf("ShadowsocksClient.DialTCP failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	expectEchoPayload(conn, MakeTestPayload(1024), make([]byte, 1024), t)
+	conn.Close()
+
+	if _, err := NewClientWithCipher(proxyHost, proxyPort, nil); err == nil {
+		t.Error("Expected an error for a nil cipher")
+	}
+
+	proxy.Close()
+	running.Wait()
+}
+
+func TestCipherInfo(t *testing.T) {
+	for _, tc := range []struct {
+		method                       string
+		saltSize, nonceSize, tagSize int
+	}{
+		{"chacha20-ietf-poly1305", 32, 12, 16},
+		{"aes-128-gcm", 16, 12, 16},
+		{"aes-256-gcm", 32, 12, 16},
+	} {
+		saltSize, nonceSize, tagSize, err := CipherInfo(tc.method)
+		if err != nil {
+			t.Errorf("CipherInfo(%v) failed: %v", tc.method, err)
+			continue
+		}
+		if saltSize != tc.saltSize || nonceSize != tc.nonceSize || tagSize != tc.tagSize {
+			t.Errorf("CipherInfo(%v) = %d, %d, %d. Expected %d, %d, %d", tc.method,
+				saltSize, nonceSize, tagSize, tc.saltSize, tc.nonceSize, tc.tagSize)
+		}
+	}
+	for _, method := range []string{"aes-128-ctr", "no-such-cipher"} {
+		if _, _, _, err := CipherInfo(method); err == nil {
+			t.Errorf("Expected an error for cipher %v", method)
+		}
+	}
+}
+
 func BenchmarkShadowsocksClient_DialTCP(b *testing.B) {
 	b.StopTimer()
 	b.ResetTimer()
@@ -227,11 +1145,11 @@ func startShadowsocksTCPEchoProxy(expectedTgtAddr string, t testing.TB) (net.Lis
 				ssw := NewShadowsocksWriter(clientConn, cipher)
 				ssClientConn := onet.WrapConn(clientConn, ssr, ssw)
 
-				tgtAddr, err := socks.ReadAddr(ssClientConn)
+				tgtHost, tgtPort, err := ReadTargetAddress(ssClientConn)
 				if err != nil {
 					t.Fatalf("Failed to read target address: %v", err)
 				}
-				if tgtAddr.String() != expectedTgtAddr {
+				if tgtAddr := net.JoinHostPort(tgtHost, strconv.Itoa(tgtPort)); tgtAddr != expectedTgtAddr {
 					t.Fatalf("Expected target address '%v'. Got '%v'", expectedTgtAddr, tgtAddr)
 				}
 				io.Copy(ssw, ssr)
@@ -361,3 +1279,31 @@ func BenchmarkShadowsocksClient_UDPWrite(b *testing.B) {
 		conn.WriteTo(payload, destAddr)
 	}
 }
+
+func TestSupportedCiphers(t *testing.T) {
+	ciphers := SupportedCiphers()
+	if len(ciphers) == 0 {
+		t.Fatal("No supported ciphers")
+	}
+	for _, method := range ciphers {
+		if !IsSupportedCipher(method) {
+			t.Errorf("Listed cipher %v is not supported", method)
+		}
+		if _, err := newAeadCipher(method, testPassword); err != nil {
+			t.Errorf("Listed cipher %v is rejected: %v", method, err)
+		}
+	}
+	if !IsSupportedCipher("CHACHA20-IETF-POLY1305") {
+		t.Error("Cipher names should be case-insensitive")
+	}
+	for _, method := range []string{"rc4-md5", "aes-256-cfb", "chacha20-ietf", "", "no-such-cipher"} {
+		if IsSupportedCipher(method) {
+			t.Errorf("Cipher %v should not be supported", method)
+		}
+	}
+	// The result is a copy.
+	ciphers[0] = "changed"
+	if SupportedCiphers()[0] == "changed" {
+		t.Error("SupportedCiphers returned the internal list")
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import "syscall"
+
+// tcpFastOpenConnect is TCP_FASTOPEN_CONNECT, which the syscall package lacks.
+// It is available since Linux 4.11.
+const tcpFastOpenConnect = 30
+
+// tcpFastOpenControl makes connect() return immediately, and the first write
+// send its data in the SYN if the kernel has a Fast Open cookie for the proxy.
+// Otherwise, the kernel falls back to a normal handshake, so errors are ignored.
+var tcpFastOpenControl = func(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	})
+}
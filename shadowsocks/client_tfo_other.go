@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import "syscall"
+
+// TCP Fast Open is only implemented on Linux.  Elsewhere, connections use a
+// normal handshake.
+var tcpFastOpenControl func(network, address string, c syscall.RawConn) error
@@ -0,0 +1,60 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// SealMessage encrypts `plaintext` as a complete Shadowsocks stream, with a
+// random salt and as many chunks as needed, for short messages that don't
+// warrant a Writer.  An empty message is sealed as an empty chunk, so that
+// it is still authenticated.
+func SealMessage(ssCipher shadowaead.Cipher, plaintext []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := NewShadowsocksWriter(&buf, ssCipher)
+	if len(plaintext) == 0 {
+		if err := writer.init(); err != nil {
+			return nil, err
+		}
+		if err := writer.KeepAlive(); err != nil {
+			return nil, err
+		}
+	} else if _, err := writer.Write(plaintext); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// OpenMessage decrypts a message sealed by SealMessage.  It fails unless the
+// message contains at least one authenticated chunk.  As with any Shadowsocks
+// stream, a message that was truncated at a chunk boundary cannot be told
+// apart from a shorter message, so callers that need to detect truncation
+// should include the length in the plaintext.
+func OpenMessage(ssCipher shadowaead.Cipher, ciphertext []byte) ([]byte, error) {
+	cr := &chunkReader{reader: bytes.NewReader(ciphertext), ssCipher: ssCipher}
+	plaintext, err := ioutil.ReadAll(&readConverter{cr: cr})
+	if err != nil {
+		return nil, err
+	}
+	if !cr.authenticated {
+		return nil, errors.New("message has no chunks")
+	}
+	return plaintext, nil
+}
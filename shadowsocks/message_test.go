@@ -0,0 +1,59 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealOpenMessage(t *testing.T) {
+	cipher := newTestCipher(t)
+	for _, size := range []int{0, 1, payloadSizeMask, payloadSizeMask + 2} {
+		plaintext := MakeTestPayload(size)
+		ciphertext, err := SealMessage(cipher, plaintext)
+		if err != nil {
+			t.Fatalf("SealMessage failed for %d bytes: %v", size, err)
+		}
+		opened, err := OpenMessage(cipher, ciphertext)
+		if err != nil {
+			t.Fatalf("OpenMessage failed for %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Errorf("Wrong content for %d bytes", size)
+		}
+	}
+}
+
+func TestOpenMessageInvalid(t *testing.T) {
+	cipher := newTestCipher(t)
+	ciphertext, err := SealMessage(cipher, []byte("hello"))
+	if err != nil {
+		t.Fatalf("SealMessage failed: %v", err)
+	}
+	// Empty, salt only, truncated mid-chunk and corrupted.
+	corrupted := append([]byte(nil), ciphertext...)
+	corrupted[len(corrupted)-1] ^= 1
+	for _, invalid := range [][]byte{
+		nil,
+		ciphertext[:cipher.SaltSize()],
+		ciphertext[:len(ciphertext)-1],
+		corrupted,
+	} {
+		if _, err := OpenMessage(cipher, invalid); err == nil {
+			t.Errorf("Expected an error for a %d-byte message", len(invalid))
+		}
+	}
+}
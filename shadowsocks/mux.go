@@ -0,0 +1,578 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Multiplexed streams are carried as frames in the decrypted payload of a single
+// Shadowsocks TCP connection.  Each frame has a 7-byte header, containing the
+// stream ID (4 bytes), the frame type (1 byte) and the payload length (2 bytes),
+// all big-endian, followed by the payload.  Streams opened by the side that
+// dialed the connection have odd IDs, and those opened by the other side have
+// even IDs, so that both sides can open streams at the same time.
+const (
+	// muxFrameOpen opens a stream.  The payload is the SOCKS target address.
+	muxFrameOpen = 0
+	// muxFrameData carries stream data.
+	muxFrameData = 1
+	// muxFrameFin means that the sender will not send more data on the stream.
+	muxFrameFin = 2
+	// muxFrameReset means that the sender has closed the stream.
+	muxFrameReset = 3
+	// muxFrameWindow allows the receiver to send more data.  The payload is the
+	// increment to the send window, as a 4-byte big-endian integer.
+	muxFrameWindow = 4
+)
+
+const muxHeaderSize = 7
+
+// muxMaxFramePayload makes each frame fit in one Shadowsocks chunk.
+const muxMaxFramePayload = payloadSizeMask - muxHeaderSize
+
+// muxWindowSize is the amount of data that a stream may have in flight, which
+// bounds the receive buffer of each stream.
+const muxWindowSize = 256 * 1024
+
+var (
+	errMuxStreamClosed = errors.New("mux stream is closed")
+	errMuxStreamReset  = errors.New("mux stream was reset by the peer")
+	errMuxSessionEnded = errors.New("mux session ended")
+)
+
+// muxTimeoutError is returned by stream operations after their deadline.
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "i/o timeout" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+// MuxDialer carries many TCP streams over one Shadowsocks connection, avoiding
+// a TCP and salt exchange per stream.  The connection goes to a multiplexing
+// endpoint at `muxAddr`, which must demultiplex the streams and connect each to
+// its own target.  This is experimental: the proxy in this repository does not
+// implement the endpoint.
+type MuxDialer struct {
+	client  Client
+	muxAddr string
+
+	mu      sync.Mutex
+	session *muxSession
+}
+
+// NewMuxDialer creates a MuxDialer that reaches the multiplexing endpoint at
+// `muxAddr` through `client`.
+func NewMuxDialer(client Client, muxAddr string) *MuxDialer {
+	return &MuxDialer{client: client, muxAddr: muxAddr}
+}
+
+// DialTCP opens a stream to `raddr` on the shared connection, which is dialed on
+// first use, and again if it fails.  `raddr` has the form `host:port`.
+// Closing the returned stream does not affect the other streams.  Its deadlines
+// do not apply while waiting for the shared connection to accept data.
+func (d *MuxDialer) DialTCP(raddr string) (onet.DuplexConn, error) {
+	target, err := parseTargetAddr(raddr)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	if d.session == nil || d.session.Err() != nil {
+		conn, err := d.client.DialTCP(nil, d.muxAddr)
+		if err != nil {
+			d.mu.Unlock()
+			return nil, err
+		}
+		d.session = newMuxSession(conn, nil, true)
+	}
+	session := d.session
+	d.mu.Unlock()
+	return session.open(target)
+}
+
+// Close closes the shared connection, which ends all of its streams.
+func (d *MuxDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session == nil {
+		return nil
+	}
+	err := d.session.Close()
+	d.session = nil
+	return err
+}
+
+// muxSession multiplexes streams over `conn`.
+type muxSession struct {
+	conn net.Conn
+	// Streams opened by the peer are sent to `accept`.  If nil, they are reset.
+	accept chan *muxStream
+
+	writeMu  sync.Mutex
+	writeBuf []byte
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	// The ID of the next stream opened locally, which advances by 2.
+	nextID uint32
+	err    error
+}
+
+// newMuxSession starts a session over `conn`.  `dialer` tells whether this side
+// dialed `conn`, which determines the parity of the IDs of the streams it opens.
+func newMuxSession(conn net.Conn, accept chan *muxStream, dialer bool) *muxSession {
+	s := &muxSession{
+		conn:     conn,
+		accept:   accept,
+		writeBuf: make([]byte, muxHeaderSize+muxMaxFramePayload),
+		streams:  make(map[uint32]*muxStream),
+		nextID:   2,
+	}
+	if dialer {
+		s.nextID = 1
+	}
+	go s.readLoop()
+	return s
+}
+
+// Err returns the error that ended the session, or nil if it is still running.
+func (s *muxSession) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *muxSession) Close() error {
+	return s.fail(errMuxSessionEnded)
+}
+
+// fail ends the session and all of its streams with `err`, and closes the
+// connection.  Only the first call has an effect, and it returns the result of
+// closing the connection.
+func (s *muxSession) fail(err error) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mu.Unlock()
+	for _, stream := range streams {
+		stream.mu.Lock()
+		stream.sessionErr = err
+		stream.cond.Broadcast()
+		stream.mu.Unlock()
+	}
+	return s.conn.Close()
+}
+
+func (s *muxSession) open(target socks.Addr) (*muxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	stream := newMuxStream(s, s.nextID, target)
+	s.streams[stream.id] = stream
+	s.nextID += 2
+	s.mu.Unlock()
+	if err := s.writeFrame(stream.id, muxFrameOpen, target); err != nil {
+		s.remove(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *muxSession) writeFrame(id uint32, frameType byte, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	frame := s.writeBuf[:muxHeaderSize+len(payload)]
+	binary.BigEndian.PutUint32(frame, id)
+	frame[4] = frameType
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	copy(frame[muxHeaderSize:], payload)
+	if _, err := s.conn.Write(frame); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (s *muxSession) writeWindow(id uint32, increment int) error {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(increment))
+	return s.writeFrame(id, muxFrameWindow, payload[:])
+}
+
+// readLoop dispatches incoming frames until the connection fails.
+// It never writes to the connection itself, so that it keeps reading while a
+// write is blocked on the peer.
+func (s *muxSession) readLoop() {
+	header := make([]byte, muxHeaderSize)
+	payload := make([]byte, muxMaxFramePayload)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			if err == io.EOF {
+				err = errMuxSessionEnded
+			}
+			s.fail(err)
+			return
+		}
+		id := binary.BigEndian.Uint32(header)
+		size := int(binary.BigEndian.Uint16(header[5:]))
+		if size > muxMaxFramePayload {
+			s.fail(fmt.Errorf("mux frame of %v bytes exceeds limit", size))
+			return
+		}
+		if _, err := io.ReadFull(s.conn, payload[:size]); err != nil {
+			s.fail(err)
+			return
+		}
+		if err := s.handleFrame(id, header[4], payload[:size]); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) handleFrame(id uint32, frameType byte, payload []byte) error {
+	if frameType == muxFrameOpen {
+		return s.handleOpen(id, payload)
+	}
+	s.mu.Lock()
+	stream := s.streams[id]
+	s.mu.Unlock()
+	if stream == nil {
+		// The stream was closed locally, and the peer will get a reset.
+		return nil
+	}
+	switch frameType {
+	case muxFrameData:
+		return stream.receive(payload)
+	case muxFrameFin:
+		stream.mu.Lock()
+		stream.readEOF = true
+		stream.cond.Broadcast()
+		stream.mu.Unlock()
+	case muxFrameReset:
+		stream.mu.Lock()
+		stream.peerReset = true
+		stream.cond.Broadcast()
+		stream.mu.Unlock()
+	case muxFrameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("mux window frame has %v bytes", len(payload))
+		}
+		stream.mu.Lock()
+		stream.sendWindow += int(binary.BigEndian.Uint32(payload))
+		stream.cond.Broadcast()
+		stream.mu.Unlock()
+	default:
+		return fmt.Errorf("unknown mux frame type %v", frameType)
+	}
+	return nil
+}
+
+func (s *muxSession) handleOpen(id uint32, payload []byte) error {
+	target, err := socks.ReadAddr(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to read mux target address: %v", err)
+	}
+	s.mu.Lock()
+	if id%2 == s.nextID%2 {
+		s.mu.Unlock()
+		return fmt.Errorf("mux stream %v has the ID parity of local streams", id)
+	}
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("mux stream %v is already open", id)
+	}
+	stream := newMuxStream(s, id, target)
+	s.streams[id] = stream
+	s.mu.Unlock()
+	select {
+	case s.accept <- stream:
+	default:
+		// Also taken when `accept` is nil.
+		s.remove(id)
+		go s.writeFrame(id, muxFrameReset, nil)
+	}
+	return nil
+}
+
+// muxStream is a stream of a muxSession.
+type muxStream struct {
+	session *muxSession
+	id      uint32
+	// The SOCKS address of the stream's destination.
+	target socks.Addr
+
+	mu         sync.Mutex
+	cond       *sync.Cond // Broadcast on every state change.
+	readBuf    bytes.Buffer
+	unacked    int  // Bytes read since the last window frame.
+	readEOF    bool // The peer sent a fin.
+	readClosed bool
+	// Bytes that the peer can accept.
+	sendWindow  int
+	writeClosed bool
+	closed      bool
+	peerReset   bool
+	sessionErr  error
+	readTimer   muxDeadline
+	writeTimer  muxDeadline
+}
+
+// muxDeadline tracks a stream deadline.  `expired` is protected by the stream mutex.
+type muxDeadline struct {
+	timer   *time.Timer
+	gen     int
+	expired bool
+}
+
+func newMuxStream(session *muxSession, id uint32, target socks.Addr) *muxStream {
+	stream := &muxStream{session: session, id: id, target: target, sendWindow: muxWindowSize}
+	stream.cond = sync.NewCond(&stream.mu)
+	return stream
+}
+
+// receive buffers incoming data.  It is called from the session's read loop,
+// so it must not block.
+func (c *muxStream) receive(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readClosed || c.closed {
+		// Nobody will read the data, so give its window back.
+		go c.session.writeWindow(c.id, len(data))
+		return nil
+	}
+	if c.readBuf.Len()+len(data) > muxWindowSize {
+		return fmt.Errorf("mux stream %v exceeded its window", c.id)
+	}
+	c.readBuf.Write(data)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *muxStream) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for c.readBuf.Len() == 0 {
+		if err := c.readErrLocked(); err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.cond.Wait()
+	}
+	n, _ := c.readBuf.Read(b)
+	c.unacked += n
+	// Batch window updates, to avoid a frame per read.
+	var increment int
+	if c.unacked >= muxWindowSize/2 {
+		increment = c.unacked
+		c.unacked = 0
+	}
+	c.mu.Unlock()
+	if increment > 0 {
+		c.session.writeWindow(c.id, increment)
+	}
+	return n, nil
+}
+
+// readErrLocked returns the error for a read on an empty buffer, or nil if the
+// read should wait.
+func (c *muxStream) readErrLocked() error {
+	switch {
+	case c.readClosed || c.closed:
+		return errMuxStreamClosed
+	case c.readEOF:
+		return io.EOF
+	case c.peerReset:
+		return errMuxStreamReset
+	case c.sessionErr != nil:
+		return c.sessionErr
+	case c.readTimer.expired:
+		return muxTimeoutError{}
+	}
+	return nil
+}
+
+func (c *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		c.mu.Lock()
+		for {
+			if err := c.writeErrLocked(); err != nil {
+				c.mu.Unlock()
+				return written, err
+			}
+			if c.sendWindow > 0 {
+				break
+			}
+			c.cond.Wait()
+		}
+		n := len(b)
+		if n > c.sendWindow {
+			n = c.sendWindow
+		}
+		if n > muxMaxFramePayload {
+			n = muxMaxFramePayload
+		}
+		c.sendWindow -= n
+		c.mu.Unlock()
+		if err := c.session.writeFrame(c.id, muxFrameData, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *muxStream) writeErrLocked() error {
+	switch {
+	case c.writeClosed || c.closed:
+		return errMuxStreamClosed
+	case c.peerReset:
+		return errMuxStreamReset
+	case c.sessionErr != nil:
+		return c.sessionErr
+	case c.writeTimer.expired:
+		return muxTimeoutError{}
+	}
+	return nil
+}
+
+func (c *muxStream) CloseRead() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errMuxStreamClosed
+	}
+	c.readClosed = true
+	if discarded := c.readBuf.Len(); discarded > 0 {
+		c.readBuf.Reset()
+		go c.session.writeWindow(c.id, discarded)
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *muxStream) CloseWrite() error {
+	c.mu.Lock()
+	if c.closed || c.writeClosed {
+		c.mu.Unlock()
+		return errMuxStreamClosed
+	}
+	c.writeClosed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return c.session.writeFrame(c.id, muxFrameFin, nil)
+}
+
+// Close ends the stream in both directions, and resets it unless the peer already has.
+func (c *muxStream) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errMuxStreamClosed
+	}
+	c.closed = true
+	c.readBuf.Reset()
+	c.stopTimerLocked(&c.readTimer)
+	c.stopTimerLocked(&c.writeTimer)
+	sendReset := !c.peerReset && c.sessionErr == nil
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.session.remove(c.id)
+	if sendReset {
+		return c.session.writeFrame(c.id, muxFrameReset, nil)
+	}
+	return nil
+}
+
+func (c *muxStream) LocalAddr() net.Addr {
+	return c.session.conn.LocalAddr()
+}
+
+func (c *muxStream) RemoteAddr() net.Addr {
+	return c.session.conn.RemoteAddr()
+}
+
+func (c *muxStream) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *muxStream) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.readTimer, t)
+	return nil
+}
+
+func (c *muxStream) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.writeTimer, t)
+	return nil
+}
+
+func (c *muxStream) setDeadline(d *muxDeadline, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopTimerLocked(d)
+	d.expired = false
+	if t.IsZero() {
+		return
+	}
+	wait := time.Until(t)
+	if wait <= 0 {
+		d.expired = true
+		c.cond.Broadcast()
+		return
+	}
+	// `gen` ignores a timer that fires after it was stopped.
+	gen := d.gen
+	d.timer = time.AfterFunc(wait, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if d.gen == gen {
+			d.expired = true
+			c.cond.Broadcast()
+		}
+	})
+}
+
+func (c *muxStream) stopTimerLocked(d *muxDeadline) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.gen++
+}
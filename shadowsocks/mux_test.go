@@ -0,0 +1,330 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const testMuxAddr = "mux.local:2222"
+
+// startShadowsocksMuxEchoProxy runs a proxy that demultiplexes the streams of each
+// connection, and echoes each stream.  `connections` counts the proxy connections.
+func startShadowsocksMuxEchoProxy(t testing.TB, connections *int32) (net.Listener, *sync.WaitGroup) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	cipher, err := newAeadCipher(testCipher, testPassword)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	var running sync.WaitGroup
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		defer listener.Close()
+		for {
+			clientConn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(connections, 1)
+			ssConn := onet.WrapConn(clientConn, NewShadowsocksReader(clientConn, cipher), NewShadowsocksWriter(clientConn, cipher))
+			if _, err := socks.ReadAddr(ssConn); err != nil {
+				t.Errorf("Failed to read mux address: %v", err)
+				clientConn.Close()
+				continue
+			}
+			accept := make(chan *muxStream, 16)
+			session := newMuxSession(ssConn, accept, false)
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				for {
+					select {
+					case stream := <-accept:
+						go func() {
+							defer stream.Close()
+							io.Copy(stream, stream)
+							stream.CloseWrite()
+						}()
+					case <-time.After(10 * time.Millisecond):
+						if session.Err() != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return listener, &running
+}
+
+func newTestMuxDialer(t *testing.T, proxy net.Listener) *MuxDialer {
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	client, err := NewClient(proxyHost, proxyPort, testPassword, testCipher)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	return NewMuxDialer(client, testMuxAddr)
+}
+
+// echoMuxStream writes `payload` and checks that it is echoed back.
+// The payload is written concurrently, to exercise flow control.
+func echoMuxStream(t *testing.T, conn onet.DuplexConn, payload []byte) {
+	go func() {
+		conn.Write(payload)
+		conn.CloseWrite()
+	}()
+	echo, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Errorf("Failed to read echo: %v", err)
+	}
+	if !bytes.Equal(echo, payload) {
+		t.Errorf("Echo mismatch: got %v bytes, expected %v", len(echo), len(payload))
+	}
+}
+
+func TestMuxDialer(t *testing.T) {
+	var connections int32
+	proxy, running := startShadowsocksMuxEchoProxy(t, &connections)
+	d := newTestMuxDialer(t, proxy)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		conn, err := d.DialTCP(testTargetAddr)
+		if err != nil {
+			t.Fatalf("MuxDialer.DialTCP failed: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			// Larger than the window, so the writer has to wait for updates.
+			echoMuxStream(t, conn, MakeTestPayload(3*muxWindowSize+1))
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("Expected 1 proxy connection, got %v", n)
+	}
+
+	d.Close()
+	proxy.Close()
+	running.Wait()
+}
+
+func TestMuxDialer_CloseStream(t *testing.T) {
+	var connections int32
+	proxy, running := startShadowsocksMuxEchoProxy(t, &connections)
+	d := newTestMuxDialer(t, proxy)
+
+	first, err := d.DialTCP(testTargetAddr)
+	if err != nil {
+		t.Fatalf("MuxDialer.DialTCP failed: %v", err)
+	}
+	second, err := d.DialTCP(testTargetAddr)
+	if err != nil {
+		t.Fatalf("MuxDialer.DialTCP failed: %v", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if _, err := first.Write([]byte{1}); err != errMuxStreamClosed {
+		t.Errorf("Expected errMuxStreamClosed, got %v", err)
+	}
+	echoMuxStream(t, second, MakeTestPayload(100))
+	second.Close()
+
+	d.Close()
+	proxy.Close()
+	running.Wait()
+}
+
+func TestMuxDialer_Redial(t *testing.T) {
+	var connections int32
+	proxy, running := startShadowsocksMuxEchoProxy(t, &connections)
+	d := newTestMuxDialer(t, proxy)
+
+	conn, err := d.DialTCP(testTargetAddr)
+	if err != nil {
+		t.Fatalf("MuxDialer.DialTCP failed: %v", err)
+	}
+	// Fail the shared connection.
+	d.session.conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the stream to fail with its connection")
+	}
+	conn, err = d.DialTCP(testTargetAddr)
+	if err != nil {
+		t.Fatalf("MuxDialer.DialTCP failed: %v", err)
+	}
+	echoMuxStream(t, conn, MakeTestPayload(100))
+	conn.Close()
+	if n := atomic.LoadInt32(&connections); n != 2 {
+		t.Errorf("Expected 2 proxy connections, got %v", n)
+	}
+
+	d.Close()
+	proxy.Close()
+	running.Wait()
+}
+
+// newMuxSessionPair returns a dialing session and an accepting session that are
+// connected in memory.
+func newMuxSessionPair() (*muxSession, chan *muxStream) {
+	left, right := net.Pipe()
+	accept := make(chan *muxStream, 1)
+	newMuxSession(right, accept, false)
+	return newMuxSession(left, nil, true), accept
+}
+
+func TestMuxStream_FlowControl(t *testing.T) {
+	dialer, accept := newMuxSessionPair()
+	defer dialer.Close()
+	stream, err := dialer.open(socks.ParseAddr(testTargetAddr))
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	peer := <-accept
+	if peer.target.String() != testTargetAddr {
+		t.Errorf("Wrong target %v", peer.target)
+	}
+
+	// Nobody reads, so the write stops at the window.
+	stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := stream.Write(make([]byte, muxWindowSize+1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if n != muxWindowSize {
+		t.Errorf("Wrote %v bytes, expected %v", n, muxWindowSize)
+	}
+
+	// Reading reopens the window.
+	if _, err := io.ReadFull(peer, make([]byte, muxWindowSize)); err != nil {
+		t.Fatalf("ReadFull failed: %v", err)
+	}
+	stream.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := stream.Write([]byte{1}); err != nil {
+		t.Errorf("Write failed after the window update: %v", err)
+	}
+}
+
+func TestMuxStream_ReadDeadline(t *testing.T) {
+	dialer, accept := newMuxSessionPair()
+	defer dialer.Close()
+	stream, err := dialer.open(socks.ParseAddr(testTargetAddr))
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	peer := <-accept
+
+	stream.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected a timeout")
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	// Clearing the deadline allows reads again.
+	stream.SetReadDeadline(time.Time{})
+	go peer.Write([]byte{1})
+	if _, err := stream.Read(make([]byte, 1)); err != nil {
+		t.Errorf("Read failed: %v", err)
+	}
+}
+
+func TestMuxStream_Reset(t *testing.T) {
+	dialer, accept := newMuxSessionPair()
+	defer dialer.Close()
+	stream, err := dialer.open(socks.ParseAddr(testTargetAddr))
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	peer := <-accept
+	peer.Close()
+	if _, err := stream.Read(make([]byte, 1)); err != errMuxStreamReset {
+		t.Errorf("Expected errMuxStreamReset, got %v", err)
+	}
+}
+
+func TestMuxSession_PeerCloseClosesConn(t *testing.T) {
+	local, remote := net.Pipe()
+	session := newMuxSession(local, nil, true)
+	remote.Close()
+	for session.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	// Reads of a net.Pipe return io.EOF if only the remote end is closed.
+	if _, err := local.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("Expected the session to close its connection, got %v", err)
+	}
+}
+
+func TestMuxSession_ConcurrentOpen(t *testing.T) {
+	const streamsPerSide = 10
+	left, right := net.Pipe()
+	leftAccept := make(chan *muxStream, streamsPerSide)
+	rightAccept := make(chan *muxStream, streamsPerSide)
+	dialer := newMuxSession(left, leftAccept, true)
+	defer dialer.Close()
+	acceptor := newMuxSession(right, rightAccept, false)
+	defer acceptor.Close()
+
+	// Both sides open streams at the same time, without ID collisions.
+	var wg sync.WaitGroup
+	for _, session := range []*muxSession{dialer, acceptor} {
+		for i := 0; i < streamsPerSide; i++ {
+			wg.Add(1)
+			go func(session *muxSession) {
+				defer wg.Done()
+				if _, err := session.open(socks.ParseAddr(testTargetAddr)); err != nil {
+					t.Errorf("open failed: %v", err)
+				}
+			}(session)
+		}
+	}
+	wg.Wait()
+	for _, accept := range []chan *muxStream{leftAccept, rightAccept} {
+		for i := 0; i < streamsPerSide; i++ {
+			select {
+			case <-accept:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Only %v streams were accepted", i)
+			}
+		}
+	}
+	if err := dialer.Err(); err != nil {
+		t.Errorf("Dialing session failed: %v", err)
+	}
+	if err := acceptor.Err(); err != nil {
+		t.Errorf("Accepting session failed: %v", err)
+	}
+}
@@ -17,6 +17,8 @@ package shadowsocks
 import (
 	"encoding/binary"
 	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // MaxCapacity is the largest allowed size of ReplayCache.
@@ -38,6 +40,10 @@ type ReplayCache struct {
 	capacity int
 	active   map[uint32]empty
 	archive  map[uint32]empty
+	// Number of times the active set was moved to the archive.
+	rotations int64
+	// Number of handshakes rejected as replays.
+	rejected int64
 }
 
 // NewReplayCache returns a fresh ReplayCache that promises to remember at least
@@ -53,6 +59,30 @@ func NewReplayCache(capacity int) ReplayCache {
 	}
 }
 
+// ReplayCacheCapacityFor returns the capacity to pass to NewReplayCache in order
+// to remember the last `expectedHandshakes` handshakes, with a false positive rate
+// of at most `maxFalsePositiveRate`.  The rate is bounded by 2 * capacity / 2^32,
+// because a handshake is checked against up to 2 * capacity stored hashes.
+//
+// The capacity is `expectedHandshakes`, clamped to MaxCapacity.  If that
+// capacity cannot meet the requested rate, or cannot remember all of the
+// expected handshakes, ok is false, and the capacity is the best available.
+func ReplayCacheCapacityFor(expectedHandshakes int, maxFalsePositiveRate float64) (capacity int, ok bool) {
+	if expectedHandshakes <= 0 {
+		return 0, true
+	}
+	capacity = expectedHandshakes
+	ok = true
+	if capacity > MaxCapacity {
+		capacity = MaxCapacity
+		ok = false
+	}
+	if 2*float64(capacity)/(1<<32) > maxFalsePositiveRate {
+		ok = false
+	}
+	return capacity, ok
+}
+
 // Trivially reduces the key and salt to a uint32, avoiding collisions
 // in case of salts with a shared prefix or suffix.  Salts are normally
 // random, but in principle a client might use a counter instead, so
@@ -89,6 +119,7 @@ func (c *ReplayCache) Add(id string, salt []byte) bool {
 	defer c.mutex.Unlock()
 	if _, ok := c.active[hash]; ok {
 		// Fast replay: `salt` is already in the active set.
+		c.rejected++
 		return false
 	}
 	_, inArchive := c.archive[hash]
@@ -96,7 +127,95 @@ func (c *ReplayCache) Add(id string, salt []byte) bool {
 		// Discard the archive and move active to archive.
 		c.archive = c.active
 		c.active = make(map[uint32]empty, c.capacity)
+		c.rotations++
 	}
 	c.active[hash] = empty{}
+	if inArchive {
+		c.rejected++
+	}
 	return !inArchive
 }
+
+// Reset forgets all handshakes, e.g. after a key rotation that invalidates
+// every prior salt.  It reuses the existing sets instead of allocating new ones.
+// The Rotations and Rejected counts are cumulative, so they are not reset.
+func (c *ReplayCache) Reset() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// The compiler turns these loops into a single map clear.
+	for hash := range c.active {
+		delete(c.active, hash)
+	}
+	for hash := range c.archive {
+		delete(c.archive, hash)
+	}
+}
+
+// ReplayCacheStats is a snapshot of the state of a ReplayCache.
+type ReplayCacheStats struct {
+	// Capacity of each of the active and archive sets.
+	Capacity int
+	// Number of handshakes in the active set.
+	Active int
+	// Number of handshakes in the archive set.
+	Archive int
+	// Number of times the active set was moved to the archive.
+	Rotations int64
+	// Number of handshakes rejected as replays.
+	Rejected int64
+}
+
+// Stats returns the current ReplayCacheStats.
+func (c *ReplayCache) Stats() ReplayCacheStats {
+	if c == nil {
+		return ReplayCacheStats{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return ReplayCacheStats{
+		Capacity:  c.capacity,
+		Active:    len(c.active),
+		Archive:   len(c.archive),
+		Rotations: c.rotations,
+		Rejected:  c.rejected,
+	}
+}
+
+var (
+	replayCacheCapacityDesc = prometheus.NewDesc("shadowsocks_replay_cache_capacity",
+		"Capacity of each of the replay cache's active and archive sets", nil, nil)
+	replayCacheEntriesDesc = prometheus.NewDesc("shadowsocks_replay_cache_entries",
+		"Handshakes stored in the replay cache", []string{"set"}, nil)
+	replayCacheRotationsDesc = prometheus.NewDesc("shadowsocks_replay_cache_rotations",
+		"Times the replay cache's active set was moved to the archive", nil, nil)
+	replayCacheRejectedDesc = prometheus.NewDesc("shadowsocks_replay_cache_rejected",
+		"Handshakes rejected by the replay cache as replays", nil, nil)
+)
+
+type replayCacheCollector struct {
+	cache *ReplayCache
+}
+
+func (rc replayCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- replayCacheCapacityDesc
+	ch <- replayCacheEntriesDesc
+	ch <- replayCacheRotationsDesc
+	ch <- replayCacheRejectedDesc
+}
+
+func (rc replayCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := rc.cache.Stats()
+	ch <- prometheus.MustNewConstMetric(replayCacheCapacityDesc, prometheus.GaugeValue, float64(stats.Capacity))
+	ch <- prometheus.MustNewConstMetric(replayCacheEntriesDesc, prometheus.GaugeValue, float64(stats.Active), "active")
+	ch <- prometheus.MustNewConstMetric(replayCacheEntriesDesc, prometheus.GaugeValue, float64(stats.Archive), "archive")
+	ch <- prometheus.MustNewConstMetric(replayCacheRotationsDesc, prometheus.CounterValue, float64(stats.Rotations))
+	ch <- prometheus.MustNewConstMetric(replayCacheRejectedDesc, prometheus.CounterValue, float64(stats.Rejected))
+}
+
+// Collector returns a prometheus.Collector that reports the cache's Stats.
+func (c *ReplayCache) Collector() prometheus.Collector {
+	return replayCacheCollector{c}
+}
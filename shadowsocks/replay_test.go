@@ -17,6 +17,8 @@ package shadowsocks
 import (
 	"encoding/binary"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const keyID = "the key"
@@ -53,6 +55,19 @@ func TestReplayCache_Active(t *testing.T) {
 	}
 }
 
+func TestReplayCache_Disabled(t *testing.T) {
+	salts := makeSalts(1)
+	var nilCache *ReplayCache
+	zeroCache := NewReplayCache(0)
+	for _, cache := range []*ReplayCache{nilCache, &zeroCache, &ReplayCache{}} {
+		for i := 0; i < 3; i++ {
+			if !cache.Add(keyID, salts[0]) {
+				t.Error("A disabled cache should accept every salt")
+			}
+		}
+	}
+}
+
 func TestReplayCache_Archive(t *testing.T) {
 	salts0 := makeSalts(10)
 	salts1 := makeSalts(10)
@@ -91,6 +106,52 @@ func TestReplayCache_Archive(t *testing.T) {
 	}
 }
 
+func TestReplayCache_Reset(t *testing.T) {
+	salts := makeSalts(3)
+	cache := NewReplayCache(2)
+	// Fill the active set and spill into the archive.
+	for _, s := range salts {
+		cache.Add(keyID, s)
+	}
+	if cache.Add(keyID, salts[0]) {
+		t.Error("Duplicate add should fail")
+	}
+	cache.Reset()
+	if stats := cache.Stats(); stats.Active != 0 || stats.Archive != 0 {
+		t.Errorf("Reset left entries: %+v", stats)
+	}
+	for _, s := range salts {
+		if !cache.Add(keyID, s) {
+			t.Error("Salts should have been forgotten by Reset")
+		}
+	}
+	var nilCache *ReplayCache
+	nilCache.Reset()
+}
+
+func TestReplayCache_Stats(t *testing.T) {
+	salts := makeSalts(3)
+	cache := NewReplayCache(2)
+	cache.Add(keyID, salts[0])
+	cache.Add(keyID, salts[0]) // Replay from the active set
+	cache.Add(keyID, salts[1])
+	cache.Add(keyID, salts[2]) // Rotation
+	cache.Add(keyID, salts[0]) // Replay from the archive
+	expected := ReplayCacheStats{Capacity: 2, Active: 2, Archive: 2, Rotations: 1, Rejected: 2}
+	if stats := cache.Stats(); stats != expected {
+		t.Errorf("Expected %+v. Got %+v", expected, stats)
+	}
+
+	if n := testutil.CollectAndCount(cache.Collector()); n != 5 {
+		t.Errorf("Expected 5 metrics. Got %d", n)
+	}
+
+	var nilCache *ReplayCache
+	if stats := nilCache.Stats(); stats != (ReplayCacheStats{}) {
+		t.Errorf("Expected empty stats for nil cache. Got %+v", stats)
+	}
+}
+
 // Benchmark to determine the memory usage of ReplayCache.
 // Note that NewReplayCache only allocates the active set,
 // so the eventual memory usage will be roughly double.
@@ -135,3 +196,27 @@ func BenchmarkReplayCache_Parallel(b *testing.B) {
 		}
 	})
 }
+
+func TestReplayCacheCapacityFor(t *testing.T) {
+	for _, tc := range []struct {
+		expected int
+		rate     float64
+		capacity int
+		ok       bool
+	}{
+		{0, 0, 0, true},
+		{1000, 1e-5, 1000, true},
+		{MaxCapacity, 1e-5, MaxCapacity, true},
+		// More handshakes than the cache can hold.
+		{MaxCapacity + 1, 1e-5, MaxCapacity, false},
+		// 2 * 1000 / 2^32 is about 4.7e-7.
+		{1000, 1e-7, 1000, false},
+		{1000, 5e-7, 1000, true},
+	} {
+		capacity, ok := ReplayCacheCapacityFor(tc.expected, tc.rate)
+		if capacity != tc.capacity || ok != tc.ok {
+			t.Errorf("ReplayCacheCapacityFor(%d, %g) = (%d, %v), want (%d, %v)",
+				tc.expected, tc.rate, capacity, ok, tc.capacity, tc.ok)
+		}
+	}
+}
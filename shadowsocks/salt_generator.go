@@ -21,7 +21,9 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"sync"
 
+	"golang.org/x/crypto/chacha20"
 	"golang.org/x/crypto/hkdf"
 )
 
@@ -56,6 +58,67 @@ func (randomSaltGenerator) IsServerSalt(salt []byte) bool {
 // RandomSaltGenerator is a basic SaltGenerator.
 var RandomSaltGenerator ServerSaltGenerator = randomSaltGenerator{}
 
+// bufferedSaltGenerator is a fast-key-erasure CSPRNG based on ChaCha20.
+// Each refill expands the current key into a block of keystream, and the
+// first bytes of the block immediately replace the key, so compromising the
+// state never reveals salts that were already issued.
+type bufferedSaltGenerator struct {
+	mu  sync.Mutex
+	key [chacha20.KeySize]byte
+	buf [bufferedSaltBlockSize]byte
+	// Unused output remaining in buf.
+	unread []byte
+}
+
+// Number of bytes of keystream generated per refill, including the next key.
+const bufferedSaltBlockSize = 1024
+
+// NewBufferedSaltGenerator returns a SaltGenerator that is seeded once from
+// crypto/rand and afterwards generates salts from its own ChaCha20 keystream.
+// This amortizes reads from the system entropy source, which can become a
+// bottleneck when creating thousands of connections per second.
+func NewBufferedSaltGenerator() (SaltGenerator, error) {
+	sg := &bufferedSaltGenerator{}
+	if _, err := rand.Read(sg.key[:]); err != nil {
+		return nil, fmt.Errorf("failed to seed salt generator: %v", err)
+	}
+	return sg, nil
+}
+
+// refill replaces the key and fills sg.unread.  sg.mu must be held.
+func (sg *bufferedSaltGenerator) refill() {
+	// The key is never reused, so a fixed nonce is safe.
+	var nonce [chacha20.NonceSize]byte
+	c, err := chacha20.NewUnauthenticatedCipher(sg.key[:], nonce[:])
+	if err != nil {
+		panic(err) // Unreachable: the key and nonce sizes are fixed.
+	}
+	for i := range sg.buf {
+		sg.buf[i] = 0
+	}
+	c.XORKeyStream(sg.buf[:], sg.buf[:])
+	copy(sg.key[:], sg.buf[:len(sg.key)])
+	sg.unread = sg.buf[len(sg.key):]
+}
+
+// GetSalt fills salt from the keystream, erasing the output as it is used.
+func (sg *bufferedSaltGenerator) GetSalt(salt []byte) error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	for len(salt) > 0 {
+		if len(sg.unread) == 0 {
+			sg.refill()
+		}
+		n := copy(salt, sg.unread)
+		for i := range sg.unread[:n] {
+			sg.unread[i] = 0
+		}
+		sg.unread = sg.unread[n:]
+		salt = salt[n:]
+	}
+	return nil
+}
+
 // serverSaltGenerator generates unique salts that are secretly marked.
 type serverSaltGenerator struct {
 	key []byte
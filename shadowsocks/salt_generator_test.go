@@ -35,6 +35,37 @@ func TestRandomSaltGenerator(t *testing.T) {
 	}
 }
 
+func TestBufferedSaltGenerator(t *testing.T) {
+	sg, err := NewBufferedSaltGenerator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Draw enough salts to span several refills, including salts that
+	// straddle a block boundary.
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		salt := make([]byte, 32)
+		if err := sg.GetSalt(salt); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(salt, make([]byte, 32)) {
+			t.Fatal("Salt is all zeros")
+		}
+		if seen[string(salt)] {
+			t.Fatal("Salt was repeated")
+		}
+		seen[string(salt)] = true
+	}
+	// A salt larger than the block is also filled.
+	salt := make([]byte, 2*bufferedSaltBlockSize)
+	if err := sg.GetSalt(salt); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(salt[len(salt)-32:], make([]byte, 32)) {
+		t.Error("Salt tail is all zeros")
+	}
+}
+
 // Test that ServerSaltGenerator recognizes its own salts
 func TestServerSaltRecognized(t *testing.T) {
 	ssg := NewServerSaltGenerator("test")
@@ -178,3 +209,24 @@ func BenchmarkServerSaltGenerator(b *testing.B) {
 		}
 	})
 }
+
+func benchmarkSaltGeneratorParallel(b *testing.B, sg SaltGenerator) {
+	b.RunParallel(func(pb *testing.PB) {
+		salt := make([]byte, 32)
+		for pb.Next() {
+			sg.GetSalt(salt)
+		}
+	})
+}
+
+func BenchmarkRandomSaltGenerator_Parallel(b *testing.B) {
+	benchmarkSaltGeneratorParallel(b, RandomSaltGenerator)
+}
+
+func BenchmarkBufferedSaltGenerator_Parallel(b *testing.B) {
+	sg, err := NewBufferedSaltGenerator()
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkSaltGeneratorParallel(b, sg)
+}
@@ -0,0 +1,298 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// SOCKS5 protocol constants, from RFC 1928.
+const (
+	socks5Version         = 5
+	socks5MethodNoAuth    = 0
+	socks5MethodNoneFound = 0xff
+	socks5CmdUDPAssociate = 3
+	socks5ReplySucceeded  = 0
+	socks5ReplyCmdNotSupp = 7
+	socks5UDPHeaderLen    = 3 // RSV (2 bytes) and FRAG, before the address.
+)
+
+// socks5HandshakeTimeout bounds the SOCKS5 handshake, so that clients that
+// connect and stay silent don't hold on to a goroutine and a socket.
+var socks5HandshakeTimeout = 10 * time.Second
+
+// ServeSOCKS5UDP runs a SOCKS5 server at `listenAddr` that only supports the
+// UDP ASSOCIATE command, relaying each association's packets though the
+// Shadowsocks proxy of `c`.  An association lasts until its TCP control
+// connection closes.  Only datagrams from the control connection's IP, and from
+// the port declared in the request if it's not zero, are relayed.  It blocks
+// until `ctx` is done, and then returns ctx.Err().
+func ServeSOCKS5UDP(ctx context.Context, c Client, listenAddr string) error {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	var running sync.WaitGroup
+	defer running.Wait()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+		}
+		listener.Close()
+	}()
+	for {
+		controlConn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer controlConn.Close()
+			if err := associateSOCKS5UDP(ctx, c, controlConn); err != nil {
+				logger.Debugf("SOCKS5 UDP association from %v failed: %v", controlConn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// associateSOCKS5UDP performs the SOCKS5 handshake on `controlConn`, and then
+// relays UDP packets until `controlConn` closes or `ctx` is done.
+func associateSOCKS5UDP(ctx context.Context, c Client, controlConn net.Conn) error {
+	controlConn.SetReadDeadline(time.Now().Add(socks5HandshakeTimeout))
+	declaredAddr, err := socks5Handshake(controlConn)
+	if err != nil {
+		return err
+	}
+	controlConn.SetReadDeadline(time.Time{})
+	// Only the host of the control connection may use the association, from
+	// the port it declared, if any.
+	clientAddr := clientUDPAddr{ip: controlConn.RemoteAddr().(*net.TCPAddr).IP}
+	if _, port, err := net.SplitHostPort(declaredAddr.String()); err == nil {
+		clientAddr.port, _ = strconv.Atoi(port)
+	}
+	// Receive the client's packets on the IP that the client connected to.
+	localIP := controlConn.LocalAddr().(*net.TCPAddr).IP
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		return err
+	}
+	defer relayConn.Close()
+	proxyConn, err := c.ListenUDP(nil)
+	if err != nil {
+		return err
+	}
+	defer proxyConn.Close()
+
+	reply := append([]byte{socks5Version, socks5ReplySucceeded, 0}, socks.ParseAddr(relayConn.LocalAddr().String())...)
+	if _, err := controlConn.Write(reply); err != nil {
+		return err
+	}
+
+	// The association lasts as long as the control connection.  `stopped` is
+	// closed before the connections, so that the relays can tell that their
+	// read errors mean the end of the association.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, controlConn)
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		close(stopped)
+		controlConn.Close()
+		relayConn.Close()
+		proxyConn.Close()
+	}()
+
+	// Use the client's buffer size, if it has one.
+	bufPool := pool
+	if ssc, ok := c.(*ssClient); ok {
+		bufPool = ssc.udpBuffers()
+	}
+	go relaySOCKS5FromProxy(proxyConn, relayConn, &clientAddr, bufPool, stopped)
+	relaySOCKS5ToProxy(relayConn, proxyConn, &clientAddr, bufPool, stopped)
+	<-done
+	return nil
+}
+
+// socks5Handshake negotiates the authentication method and reads the request,
+// which must be UDP ASSOCIATE.  It returns the UDP address that the client
+// declared in the request, which is often unspecified.
+func socks5Handshake(conn net.Conn) (socks.Addr, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read greeting: %v", err)
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, fmt.Errorf("failed to read methods: %v", err)
+	}
+	method := byte(socks5MethodNoneFound)
+	for _, m := range methods {
+		if m == socks5MethodNoAuth {
+			method = socks5MethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+	if method == socks5MethodNoneFound {
+		return nil, errors.New("client does not support unauthenticated access")
+	}
+
+	var request [3]byte // VER, CMD and RSV.
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return nil, fmt.Errorf("failed to read request: %v", err)
+	}
+	declaredAddr, err := socks.ReadAddr(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request address: %v", err)
+	}
+	if request[1] != socks5CmdUDPAssociate {
+		// Reply with an all-zero IPv4 address, as the address is required.
+		conn.Write([]byte{socks5Version, socks5ReplyCmdNotSupp, 0, socks.AtypIPv4, 0, 0, 0, 0, 0, 0})
+		return nil, fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+	return declaredAddr, nil
+}
+
+// clientUDPAddr holds the UDP address of the SOCKS client, once known.
+type clientUDPAddr struct {
+	// Datagrams are only accepted from `ip`, and from `port` if it's not zero.
+	ip   net.IP
+	port int
+	mu   sync.Mutex
+	addr net.Addr
+}
+
+func (a *clientUDPAddr) get() net.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.addr
+}
+
+// accept records `addr` if it's the first sender with the client's IP and
+// declared port, and reports whether `addr` is the client.
+func (a *clientUDPAddr) accept(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || !udpAddr.IP.Equal(a.ip) || (a.port != 0 && udpAddr.Port != a.port) {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.addr == nil {
+		a.addr = addr
+	}
+	return a.addr.String() == addr.String()
+}
+
+// isStopped reports whether `stopped` is closed.
+func isStopped(stopped <-chan struct{}) bool {
+	select {
+	case <-stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// relaySOCKS5ToProxy forwards datagrams from the SOCKS client to their targets
+// through the proxy, until `stopped` is closed.
+func relaySOCKS5ToProxy(relayConn net.PacketConn, proxyConn net.PacketConn, clientAddr *clientUDPAddr, bufPool *sync.Pool, stopped <-chan struct{}) {
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	for {
+		n, srcAddr, err := relayConn.ReadFrom(buf)
+		if err != nil {
+			if isStopped(stopped) {
+				return
+			}
+			logger.Debugf("Failed to read SOCKS5 UDP packet: %v", err)
+			continue
+		}
+		if !clientAddr.accept(srcAddr) {
+			continue
+		}
+		if n < socks5UDPHeaderLen || buf[2] != 0 {
+			// Fragmentation is not supported, so fragments are dropped.
+			continue
+		}
+		tgtAddr := socks.SplitAddr(buf[socks5UDPHeaderLen:n])
+		if tgtAddr == nil {
+			continue
+		}
+		payload := buf[socks5UDPHeaderLen+len(tgtAddr) : n]
+		if _, err := proxyConn.WriteTo(payload, NewAddr(tgtAddr.String(), "udp")); err != nil {
+			logger.Debugf("Failed to relay SOCKS5 UDP packet: %v", err)
+		}
+	}
+}
+
+// relaySOCKS5FromProxy forwards datagrams from the proxy to the SOCKS client,
+// adding the SOCKS5 UDP header, until `stopped` is closed.  Datagrams that
+// cannot be read, such as those that fail to decrypt, are dropped.
+func relaySOCKS5FromProxy(proxyConn net.PacketConn, relayConn net.PacketConn, clientAddr *clientUDPAddr, bufPool *sync.Pool, stopped <-chan struct{}) {
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	for {
+		n, srcAddr, err := proxyConn.ReadFrom(buf)
+		if err != nil {
+			if isStopped(stopped) {
+				return
+			}
+			logger.Debugf("Failed to read relayed SOCKS5 UDP packet: %v", err)
+			continue
+		}
+		dstAddr := clientAddr.get()
+		socksSrcAddr := socks.ParseAddr(srcAddr.String())
+		if dstAddr == nil || socksSrcAddr == nil {
+			continue
+		}
+		// Move the payload behind the header, if the packet fits in the buffer.
+		headerLen := socks5UDPHeaderLen + len(socksSrcAddr)
+		if headerLen+n > len(buf) {
+			continue
+		}
+		packet := buf[:headerLen+n]
+		copy(packet[headerLen:], packet[:n])
+		packet[0], packet[1], packet[2] = 0, 0, 0
+		copy(packet[socks5UDPHeaderLen:], socksSrcAddr)
+		relayConn.WriteTo(packet, dstAddr)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// startSOCKS5UDPServer runs ServeSOCKS5UDP on a free local port, and returns
+// its address and a channel that receives its result.  The client is configured
+// with `options`.
+func startSOCKS5UDPServer(ctx context.Context, t *testing.T, options ...ClientOption) (string, chan error) {
+	proxy, running := startShadowsocksUDPEchoServer(testTargetAddr, t)
+	t.Cleanup(func() {
+		proxy.Close()
+		running.Wait()
+	})
+	proxyHost, proxyPort, err := splitHostPortNumber(proxy.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse proxy address: %v", err)
+	}
+	d, err := NewClient(proxyHost, proxyPort, testPassword, testCipher, options...)
+	if err != nil {
+		t.Fatalf("Failed to create ShadowsocksClient: %v", err)
+	}
+	// Find a free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	listenAddr := l.Addr().String()
+	l.Close()
+	result := make(chan error, 1)
+	go func() {
+		result <- ServeSOCKS5UDP(ctx, d, listenAddr)
+	}()
+	return listenAddr, result
+}
+
+// dialSOCKS5 connects to the server at `addr`, retrying until it has started,
+// and negotiates unauthenticated access.
+func dialSOCKS5(addr string, t *testing.T) net.Conn {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to connect to SOCKS5 server: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatalf("Failed to write greeting: %v", err)
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		t.Fatalf("Failed to read method: %v", err)
+	}
+	if method != [2]byte{5, 0} {
+		t.Fatalf("Unexpected method selection %v", method)
+	}
+	return conn
+}
+
+// udpAssociateSOCKS5 requests a UDP association on `controlConn`, declaring an
+// unspecified client address, and returns the address of the relay.
+func udpAssociateSOCKS5(controlConn net.Conn, t *testing.T) socks.Addr {
+	if _, err := controlConn.Write([]byte{5, 3, 0, socks.AtypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(controlConn, reply[:]); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if reply != [3]byte{5, 0, 0} {
+		t.Fatalf("Unexpected reply %v", reply)
+	}
+	relayAddr, err := socks.ReadAddr(controlConn)
+	if err != nil {
+		t.Fatalf("Failed to read relay address: %v", err)
+	}
+	return relayAddr
+}
+
+func TestShadowsocksClient_ServeSOCKS5UDP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listenAddr, result := startSOCKS5UDPServer(ctx, t)
+	controlConn := dialSOCKS5(listenAddr, t)
+	defer controlConn.Close()
+	relayAddr := udpAssociateSOCKS5(controlConn, t)
+
+	udpConn, err := net.Dial("udp", relayAddr.String())
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	defer udpConn.Close()
+	udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	header := append([]byte{0, 0, 0}, socks.ParseAddr(testTargetAddr)...)
+	payload := MakeTestPayload(100)
+	if _, err := udpConn.Write(append(header, payload...)); err != nil {
+		t.Fatalf("Failed to write datagram: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	// The echo comes from the target, with a SOCKS5 UDP header.
+	if !bytes.Equal(buf[:n], append(header, payload...)) {
+		t.Errorf("Unexpected response %v", buf[:n])
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeSOCKS5UDP did not return after cancellation")
+	}
+}
+
+func TestShadowsocksClient_ServeSOCKS5UDPUnsupportedCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listenAddr, _ := startSOCKS5UDPServer(ctx, t)
+	controlConn := dialSOCKS5(listenAddr, t)
+	defer controlConn.Close()
+
+	// CONNECT is not supported.
+	if _, err := controlConn.Write(append([]byte{5, 1, 0}, socks.ParseAddr(testTargetAddr)...)); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(controlConn, reply[:]); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if reply != [2]byte{5, 7} {
+		t.Errorf("Expected command not supported, got %v", reply)
+	}
+}
+
+func TestShadowsocksClient_ServeSOCKS5UDPHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { socks5HandshakeTimeout = timeout }(socks5HandshakeTimeout)
+	socks5HandshakeTimeout = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listenAddr, _ := startSOCKS5UDPServer(ctx, t)
+	controlConn := dialSOCKS5(listenAddr, t)
+	defer controlConn.Close()
+
+	// The server closes the connection once the client stays silent too long.
+	start := time.Now()
+	if _, err := controlConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Server took %v to close the silent connection", elapsed)
+	}
+}
+
+func TestClientUDPAddr_Accept(t *testing.T) {
+	localhost := net.ParseIP("127.0.0.1")
+	client := &net.UDPAddr{IP: localhost, Port: 5555}
+	a := clientUDPAddr{ip: localhost, port: client.Port}
+	if a.accept(&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: client.Port}) {
+		t.Error("Accepted a datagram from another IP")
+	}
+	if a.accept(&net.UDPAddr{IP: localhost, Port: client.Port + 1}) {
+		t.Error("Accepted a datagram from an undeclared port")
+	}
+	if !a.accept(client) {
+		t.Error("Rejected a datagram from the client")
+	}
+
+	// Without a declared port, the first sender from the client's IP wins.
+	a = clientUDPAddr{ip: localhost}
+	if a.accept(&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: client.Port}) {
+		t.Error("Accepted a datagram from another IP")
+	}
+	if !a.accept(client) {
+		t.Error("Rejected a datagram from the first sender")
+	}
+	if a.accept(&net.UDPAddr{IP: localhost, Port: client.Port + 1}) {
+		t.Error("Accepted a datagram from a second sender")
+	}
+}
+
+func TestShadowsocksClient_ServeSOCKS5UDPBufferSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listenAddr, _ := startSOCKS5UDPServer(ctx, t, WithUDPBufferSize(maxUDPPayloadSize))
+	controlConn := dialSOCKS5(listenAddr, t)
+	defer controlConn.Close()
+	relayAddr := udpAssociateSOCKS5(controlConn, t)
+
+	udpConn, err := net.Dial("udp", relayAddr.String())
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	defer udpConn.Close()
+	udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Larger than the default buffer, in both directions.
+	header := append([]byte{0, 0, 0}, socks.ParseAddr(testTargetAddr)...)
+	packet := append(header, MakeTestPayload(30000)...)
+	if _, err := udpConn.Write(packet); err != nil {
+		t.Fatalf("Failed to write datagram: %v", err)
+	}
+	buf := make([]byte, maxUDPPayloadSize)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	if !bytes.Equal(buf[:n], packet) {
+		t.Errorf("Unexpected response of %v bytes", n)
+	}
+}
+
+// scriptedPacketConn is a PacketConn whose reads return the results sent on
+// `reads`, and then fail.
+type scriptedPacketConn struct {
+	net.PacketConn
+	reads chan scriptedRead
+}
+
+type scriptedRead struct {
+	payload []byte
+	addr    net.Addr
+	err     error
+}
+
+func (c *scriptedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	r, ok := <-c.reads
+	if !ok {
+		return 0, nil, errors.New("closed")
+	}
+	return copy(b, r.payload), r.addr, r.err
+}
+
+func TestRelaySOCKS5FromProxy_SurvivesReadErrors(t *testing.T) {
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	defer relayConn.Close()
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	defer clientConn.Close()
+	clientAddr := clientUDPAddr{addr: clientConn.LocalAddr()}
+	proxyConn := &scriptedPacketConn{reads: make(chan scriptedRead, 2)}
+	stopped := make(chan struct{})
+	relayDone := make(chan struct{})
+	go func() {
+		relaySOCKS5FromProxy(proxyConn, relayConn, &clientAddr, pool, stopped)
+		close(relayDone)
+	}()
+
+	// A datagram that fails to decrypt doesn't end the relay.
+	proxyConn.reads <- scriptedRead{err: errors.New("failed to decrypt")}
+	payload := MakeTestPayload(100)
+	proxyConn.reads <- scriptedRead{payload: payload, addr: NewAddr(testTargetAddr, "udp")}
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := clientConn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	expected := append(append([]byte{0, 0, 0}, socks.ParseAddr(testTargetAddr)...), payload...)
+	if !bytes.Equal(buf[:n], expected) {
+		t.Errorf("Unexpected datagram %v", buf[:n])
+	}
+
+	close(stopped)
+	close(proxyConn.reads)
+	select {
+	case <-relayDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay did not stop")
+	}
+}
@@ -17,10 +17,16 @@ package shadowsocks
 import (
 	"bytes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	mrand "math/rand"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
 )
@@ -28,12 +34,28 @@ import (
 // payloadSizeMask is the maximum size of payload in bytes.
 const payloadSizeMask = 0x3FFF // 16*1024 - 1
 
+// paddedChunkFlag marks a chunk whose payload ends with random padding.
+// The flag occupies a bit of the size field that the Shadowsocks AEAD spec
+// reserves as zero, so it is only understood by readers created with
+// NewPaddedShadowsocksReader.  The payload of a padded chunk has the layout
+// [data][padding][padding length (2 bytes, big-endian)].
+const paddedChunkFlag = 0x8000
+
+// rekeyChunkFlag marks an empty chunk after which the sender switches to a new
+// cipher.  Like paddedChunkFlag, it occupies a reserved bit of the size field.
+// See Writer.Rekey.
+const rekeyChunkFlag = 0x4000
+
 // Writer is an io.Writer that also implements io.ReaderFrom to
 // allow for piping the data without extra allocations and copies.
 // The LazyWrite and Flush methods allow a header to be
 // added but delayed until the first write, for concatenation.
-// All methods except Flush must be called from a single thread.
+// All methods except Flush and KeepAlive must be called from a single thread.
 type Writer struct {
+	// Number of bytes written to the inner Writer.  It is accessed atomically,
+	// so it must be the first field to guarantee 64-bit alignment on 32-bit
+	// platforms.
+	wireBytes int64
 	// This type is single-threaded except when needFlush is true.
 	// mu protects needFlush, and also protects everything
 	// else while needFlush could be true.
@@ -43,15 +65,68 @@ type Writer struct {
 	writer        io.Writer
 	ssCipher      shadowaead.Cipher
 	saltGenerator SaltGenerator
+	// The cipher before the first Rekey, which Reset restores, or nil if the
+	// Writer has not been rekeyed.
+	originalCipher shadowaead.Cipher
 	// Wrapper for input that arrives as a slice.
 	byteWrapper bytes.Reader
 	// Number of plaintext bytes that are currently buffered.
 	pending int
+	// Payload size of the padded final chunk written by Close, or 0 if
+	// padding is disabled.
+	lastChunkSize int
+	// Number of plaintext bytes that Write may queue before sending, or 0 if
+	// writes are sent immediately.
+	writeBufferSize int
+	// Indicates that ReadFrom fills each chunk before sending it.
+	fillChunks bool
+	// Returns the padding size of the chunk that follows each data chunk, or
+	// nil if padding chunks are disabled.
+	chunkPadding func() int
+	// Starting value of counter, for testing against known vectors.  If nil,
+	// the counter starts at zero, as the protocol requires.  Otherwise, it must
+	// have the nonce size.
+	initialCounter []byte
 	// These are populated by init():
 	buf  []byte
 	aead cipher.AEAD
+	// Buffers for the chunks after the first in a vectored write, allocated on
+	// first use.
+	vectorBufs [][]byte
+	// Buffer for the chunks that are sent apart from the pending data, i.e.
+	// keepalive, rekey and padding chunks, allocated on first use.
+	sideBuf []byte
 	// Index of the next encrypted chunk to write.
 	counter []byte
+	// Indicates that every nonce value has been used, so no more data
+	// can be encrypted.
+	nonceExhausted bool
+}
+
+// ErrNonceExhausted is returned by a Writer that has used every possible
+// nonce value.  Encrypting more data would reuse a nonce, breaking the
+// security of the AEAD, so the stream must be abandoned.  This is not
+// reachable in practice with 12-byte nonces.
+var ErrNonceExhausted = errors.New("all nonce values have been used")
+
+// StreamError is returned by a Reader or Writer when a step of the Shadowsocks
+// stream protocol fails, so that callers can tell the steps apart with
+// errors.As.  Op is one of "generate salt", "create AEAD", "generate padding",
+// "read salt", "read payload size", "read payload", "write payload", "remove
+// padding" and "rekey", and Err is the cause.  Errors for EOF, a short salt, a
+// truncated chunk or a timeout are returned as documented elsewhere, not as a
+// StreamError.
+type StreamError struct {
+	Op  string
+	Err error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("failed to %v: %v", e.Op, e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
 }
 
 // NewShadowsocksWriter creates a Writer that encrypts the given Writer using
@@ -65,25 +140,132 @@ func (sw *Writer) SetSaltGenerator(saltGenerator SaltGenerator) {
 	sw.saltGenerator = saltGenerator
 }
 
+// SetPadLastChunk makes Close send the remaining data in a final chunk whose
+// payload is padded with random bytes to at least `size` bytes, obscuring the
+// length of the end of the stream.  Must be called before the first write.
+//
+// Padding changes the wire format: the stream can only be read by a Reader
+// created with NewPaddedShadowsocksReader.  Vanilla Shadowsocks servers will
+// deliver the padding to the target as data.
+func (sw *Writer) SetPadLastChunk(size int) {
+	if size > payloadSizeMask {
+		size = payloadSizeMask
+	}
+	sw.lastChunkSize = size
+}
+
+// SetChunkPadding makes the Writer follow each data chunk with a chunk that
+// contains only random padding, so that chunk sizes on the wire don't reveal
+// the pattern of writes.  `paddingSize` is called once per data chunk and
+// returns the padding size, capped at the maximum chunk payload.  A size of 0
+// or less sends no padding chunk.  Must be called before the first write.
+//
+// Like SetPadLastChunk, this changes the wire format: the stream can only be
+// read by a Reader created with NewPaddedShadowsocksReader, and vanilla
+// Shadowsocks servers will deliver the padding to the target as data.
+func (sw *Writer) SetChunkPadding(paddingSize func() int) {
+	sw.chunkPadding = paddingSize
+}
+
+// RandomChunkPadding returns a padding size distribution for SetChunkPadding
+// that is uniform between 0 and `maxSize` bytes, inclusive.  `maxSize` is
+// clamped to the range from 0 to the maximum chunk payload.
+func RandomChunkPadding(maxSize int) func() int {
+	if maxSize < 0 {
+		maxSize = 0
+	} else if maxSize > payloadSizeMask {
+		maxSize = payloadSizeMask
+	}
+	return func() int {
+		return mrand.Intn(maxSize + 1)
+	}
+}
+
+// SetWriteBuffer makes Write queue up to `size` bytes of plaintext, as LazyWrite
+// does, instead of sending each call in its own chunk.  Queued data is sent
+// when the buffer fills, or on the next Flush, Close or ReadFrom.
+//
+// Buffering trades latency for throughput: many small writes share a single
+// chunk, saving the per-chunk framing overhead and a syscall per write, but
+// data can wait in the buffer until Flush is called.  `size` is capped at the
+// maximum chunk payload.  A size of 0, the default, disables buffering.
+// Must be called before the first write.
+func (sw *Writer) SetWriteBuffer(size int) {
+	if size > payloadSizeMask {
+		size = payloadSizeMask
+	}
+	sw.writeBufferSize = size
+}
+
+// SetFillChunks makes ReadFrom read from its source until each chunk is full,
+// or the source returns EOF or an error, instead of sending the result of each
+// source Read in its own chunk.  A chatty source then produces fewer, larger
+// chunks, saving framing overhead and segments on the wire.
+//
+// Filling blocks until a whole chunk of data has arrived, so it is only
+// suitable for bulk transfers.  Interactive protocols relayed through a
+// filling Writer would stall.  It is off by default.
+func (sw *Writer) SetFillChunks(fill bool) {
+	sw.fillChunks = fill
+}
+
+// Reset discards the Writer's state, including any queued data, and makes it
+// write a new stream to `writer`, with a fresh salt, as if newly created.  The
+// chunk buffer is kept for reuse.  The salt generator reverts to
+// RandomSaltGenerator, the cipher reverts to the one from before any Rekey, and
+// other settings are preserved.
+func (sw *Writer) Reset(writer io.Writer) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.originalCipher != nil {
+		sw.ssCipher = sw.originalCipher
+		sw.originalCipher = nil
+		// These are sized for the rotated cipher.
+		sw.sideBuf = nil
+		sw.vectorBufs = nil
+	}
+	sw.writer = writer
+	sw.saltGenerator = RandomSaltGenerator
+	sw.byteWrapper.Reset(nil)
+	sw.needFlush = false
+	sw.pending = 0
+	sw.aead = nil
+	sw.counter = nil
+	sw.nonceExhausted = false
+	atomic.StoreInt64(&sw.wireBytes, 0)
+}
+
 // init generates a random salt, sets up the AEAD object and writes
 // the salt to the inner Writer.
 func (sw *Writer) init() (err error) {
+	// Locking is needed due to potential concurrency with KeepAlive.
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.initLocked()
+}
+
+// initLocked is init, for callers that hold sw.mu.
+func (sw *Writer) initLocked() (err error) {
 	if sw.aead == nil {
 		salt := make([]byte, sw.ssCipher.SaltSize())
 		if err := sw.saltGenerator.GetSalt(salt); err != nil {
-			return fmt.Errorf("failed to generate salt: %v", err)
+			return &StreamError{Op: "generate salt", Err: err}
 		}
 		sw.aead, err = sw.ssCipher.Encrypter(salt)
 		if err != nil {
-			return fmt.Errorf("failed to create AEAD: %v", err)
+			return &StreamError{Op: "create AEAD", Err: err}
 		}
+		debugSalt("writer", salt, sw.aead)
 		sw.saltGenerator = nil // No longer needed, so release reference.
 		sw.counter = make([]byte, sw.aead.NonceSize())
+		copy(sw.counter, sw.initialCounter)
 		// The maximum length message is the salt (first message only), length, length tag,
 		// payload, and payload tag.
 		sizeBufSize := 2 + sw.aead.Overhead()
 		maxPayloadBufSize := payloadSizeMask + sw.aead.Overhead()
-		sw.buf = make([]byte, len(salt)+sizeBufSize+maxPayloadBufSize)
+		if bufSize := len(salt) + sizeBufSize + maxPayloadBufSize; len(sw.buf) != bufSize {
+			sw.buf = make([]byte, bufSize)
+		}
 		// Store the salt at the start of sw.buf.
 		copy(sw.buf, salt)
 	}
@@ -94,11 +276,23 @@ func (sw *Writer) init() (err error) {
 // for the tag. Returns the total ciphertext length.
 func (sw *Writer) encryptBlock(plaintext []byte) int {
 	out := sw.aead.Seal(plaintext[:0], sw.counter, plaintext, nil)
-	increment(sw.counter)
+	if increment(sw.counter) {
+		sw.nonceExhausted = true
+	}
 	return len(out)
 }
 
+// maxVectoredChunks is the largest number of chunks that Write sends in a
+// single vectored write.
+const maxVectoredChunks = 8
+
 func (sw *Writer) Write(p []byte) (int, error) {
+	if sw.writeBufferSize > 0 {
+		return sw.bufferedWrite(p)
+	}
+	if _, ok := sw.writer.(*net.TCPConn); ok && len(p) > payloadSizeMask && sw.chunkPadding == nil {
+		return sw.vectoredWrite(p)
+	}
 	sw.byteWrapper.Reset(p)
 	n, err := sw.ReadFrom(&sw.byteWrapper)
 	return int(n), err
@@ -133,6 +327,105 @@ func (sw *Writer) LazyWrite(p []byte) (int, error) {
 	}
 }
 
+// vectoredWrite encrypts `p`, which spans several chunks, in batches of up to
+// maxVectoredChunks chunks, and sends each batch with net.Buffers.  On a
+// *net.TCPConn, that takes a single writev system call per batch, instead of
+// a write per chunk.
+func (sw *Writer) vectoredWrite(p []byte) (int, error) {
+	if err := sw.init(); err != nil {
+		return 0, err
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.needFlush = false
+
+	written := 0
+	for len(p) > 0 {
+		// The first chunk of the batch goes in sw.buf, after any pending data,
+		// and includes the salt if it hasn't been sent yet.
+		batchSize := sw.enqueue(p)
+		p = p[batchSize:]
+		chunk, err := sw.sealChunk(0)
+		if err != nil {
+			return written, err
+		}
+		batch := make(net.Buffers, 1, maxVectoredChunks)
+		batch[0] = chunk
+		for i := 0; i < maxVectoredChunks-1 && len(p) > 0; i++ {
+			plaintext := p
+			if len(plaintext) > payloadSizeMask {
+				plaintext = plaintext[:payloadSizeMask]
+			}
+			chunk, err := sw.sealVectorChunk(i, plaintext)
+			if err != nil {
+				return written, err
+			}
+			batch = append(batch, chunk)
+			batchSize += len(plaintext)
+			p = p[len(plaintext):]
+		}
+		n, err := batch.WriteTo(sw.writer)
+		atomic.AddInt64(&sw.wireBytes, n)
+		if err != nil {
+			return written, err
+		}
+		written += batchSize
+	}
+	return written, nil
+}
+
+// sealVectorChunk encrypts `plaintext` as a whole chunk into the `i`th vector
+// buffer, and returns the chunk.
+func (sw *Writer) sealVectorChunk(i int, plaintext []byte) ([]byte, error) {
+	if sw.nonceExhausted {
+		return nil, ErrNonceExhausted
+	}
+	overhead := sw.aead.Overhead()
+	if sw.vectorBufs == nil {
+		sw.vectorBufs = make([][]byte, maxVectoredChunks-1)
+		for j := range sw.vectorBufs {
+			sw.vectorBufs[j] = make([]byte, 2+overhead+payloadSizeMask+overhead)
+		}
+	}
+	buf := sw.vectorBufs[i]
+	binary.BigEndian.PutUint16(buf, uint16(len(plaintext)))
+	sizeBlockSize := sw.encryptBlock(buf[:2])
+	debugChunk("writer", sw.counter, uint16(len(plaintext)))
+	payloadStart := 2 + overhead
+	copy(buf[payloadStart:], plaintext)
+	payloadSize := sw.encryptBlock(buf[payloadStart : payloadStart+len(plaintext)])
+	return buf[:sizeBlockSize+payloadSize], nil
+}
+
+// bufferedWrite queues p, sending a chunk each time the pending data reaches
+// sw.writeBufferSize.
+func (sw *Writer) bufferedWrite(p []byte) (int, error) {
+	if err := sw.init(); err != nil {
+		return 0, err
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	queued := 0
+	for len(p) > 0 {
+		if room := sw.writeBufferSize - sw.pending; room > 0 {
+			if room > len(p) {
+				room = len(p)
+			}
+			n := sw.enqueue(p[:room])
+			queued += n
+			p = p[n:]
+		}
+		if sw.pending >= sw.writeBufferSize {
+			if err := sw.flush(); err != nil {
+				return queued, err
+			}
+		}
+	}
+	sw.needFlush = sw.pending > 0
+	return queued, nil
+}
+
 // Flush sends the pending data, if any.  This method is thread-safe.
 func (sw *Writer) Flush() error {
 	sw.mu.Lock()
@@ -143,6 +436,51 @@ func (sw *Writer) Flush() error {
 	return sw.flush()
 }
 
+// Close sends any pending data, in a padded chunk if SetPadLastChunk was
+// called.  Like gzip.Writer, Close does not close the underlying writer.
+// No writes are allowed after Close.
+func (sw *Writer) Close() error {
+	if sw.lastChunkSize == 0 {
+		return sw.Flush()
+	}
+	if err := sw.init(); err != nil {
+		return err
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.needFlush = false
+
+	_, payloadBuf := sw.buffers()
+	if sw.pending+2 > len(payloadBuf) {
+		// There is no room for the padding length, so the pending data goes
+		// out in a normal chunk, followed by a chunk containing only padding.
+		if err := sw.flush(); err != nil {
+			return err
+		}
+	}
+	padLen := sw.lastChunkSize - sw.pending - 2
+	if padLen < 0 {
+		padLen = 0
+	}
+	if err := sw.appendPadding(padLen); err != nil {
+		return err
+	}
+	return sw.flushChunk(paddedChunkFlag)
+}
+
+// appendPadding adds `padLen` random bytes and the padding length after the
+// pending data, which must leave room for them.
+func (sw *Writer) appendPadding(padLen int) error {
+	_, payloadBuf := sw.buffers()
+	padding := payloadBuf[sw.pending : sw.pending+padLen]
+	if _, err := rand.Read(padding); err != nil {
+		return &StreamError{Op: "generate padding", Err: err}
+	}
+	binary.BigEndian.PutUint16(payloadBuf[sw.pending+padLen:], uint16(padLen))
+	sw.pending += padLen + 2
+	return nil
+}
+
 func isZero(b []byte) bool {
 	for _, v := range b {
 		if v != 0 {
@@ -152,6 +490,14 @@ func isZero(b []byte) bool {
 	return true
 }
 
+// isFirstChunk reports whether no chunks have been written yet.
+func (sw *Writer) isFirstChunk() bool {
+	if sw.initialCounter != nil {
+		return bytes.Equal(sw.counter, sw.initialCounter)
+	}
+	return isZero(sw.counter)
+}
+
 // Returns the slices of sw.buf in which to place plaintext for encryption.
 func (sw *Writer) buffers() (sizeBuf, payloadBuf []byte) {
 	// sw.buf starts with the salt.
@@ -171,7 +517,8 @@ func (sw *Writer) ReadFrom(r io.Reader) (int64, error) {
 		return 0, err
 	}
 	var written int64
-	var err error
+	// err is from `r`, and writeErr from the flush.
+	var err, writeErr error
 	_, payloadBuf := sw.buffers()
 
 	// Special case: one thread-safe read, if necessary
@@ -192,26 +539,46 @@ func (sw *Writer) ReadFrom(r io.Reader) (int64, error) {
 		sw.mu.Lock()
 
 		sw.enqueue(readBuf[:plaintextSize])
-		if flushErr := sw.flush(); flushErr != nil {
-			err = flushErr
-		}
+		writeErr = sw.flush()
 		sw.needFlush = false
 	}
 	sw.mu.Unlock()
 
+	// A Reader returns at most one chunk's payload per Read, and if the
+	// buffer also has room for the tag, it decrypts each chunk directly into
+	// payloadBuf, avoiding a copy.
+	readBuf := payloadBuf
+	if _, ok := r.(*readConverter); ok && !sw.fillChunks {
+		readBuf = payloadBuf[:cap(payloadBuf)]
+	}
+
 	// Main transfer loop
-	for err == nil {
-		sw.pending, err = r.Read(payloadBuf)
-		written += int64(sw.pending)
-		if flushErr := sw.flush(); flushErr != nil {
-			err = flushErr
+	for err == nil && writeErr == nil {
+		var n int
+		if sw.fillChunks {
+			n, err = io.ReadFull(r, readBuf)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+		} else {
+			n, err = r.Read(readBuf)
 		}
+		written += int64(n)
+		// Locking is needed due to potential concurrency with KeepAlive, which
+		// uses the counter and the inner Writer, but not payloadBuf.
+		sw.mu.Lock()
+		sw.pending = n
+		writeErr = sw.flush()
+		sw.mu.Unlock()
 	}
 
+	if writeErr != nil {
+		return written, &StreamError{Op: "write payload", Err: writeErr}
+	}
 	if err == io.EOF { // ignore EOF as per io.ReaderFrom contract
 		return written, nil
 	}
-	return written, fmt.Errorf("Failed to read payload: %v", err)
+	return written, &StreamError{Op: "read payload", Err: err}
 }
 
 // Adds as much of `plaintext` into the buffer as will fit, and increases
@@ -223,16 +590,51 @@ func (sw *Writer) enqueue(plaintext []byte) int {
 	return n
 }
 
-// Encrypts all pending data and writes it to the output.
+// Encrypts all pending data and writes it to the output, followed by a
+// padding chunk if SetChunkPadding was called.
 func (sw *Writer) flush() error {
+	sentData := sw.pending > 0
+	if err := sw.flushChunk(0); err != nil || !sentData || sw.chunkPadding == nil {
+		return err
+	}
+	padLen := sw.chunkPadding()
+	if padLen <= 0 {
+		return nil
+	}
+	if padLen > payloadSizeMask-2 {
+		padLen = payloadSizeMask - 2
+	}
+	return sw.sendSideChunk(paddedChunkFlag, padLen)
+}
+
+// Encrypts all pending data and writes it to the output as a single chunk,
+// with `flags` set in the size field.
+func (sw *Writer) flushChunk(flags uint16) error {
 	if sw.pending == 0 {
 		return nil
 	}
+	chunk, err := sw.sealChunk(flags)
+	if err != nil {
+		return err
+	}
+	n, err := sw.writer.Write(chunk)
+	atomic.AddInt64(&sw.wireBytes, int64(n))
+	return err
+}
+
+// sealChunk encrypts all pending data as a single chunk, with `flags` set in
+// the size field, and returns the chunk, preceded by the salt if this is the
+// first chunk.
+func (sw *Writer) sealChunk(flags uint16) ([]byte, error) {
+	if sw.nonceExhausted {
+		// Nonces come in pairs, so there is either room for a whole chunk or none.
+		return nil, ErrNonceExhausted
+	}
 	// sw.buf starts with the salt.
 	saltSize := sw.ssCipher.SaltSize()
 	// Normally we ignore the salt at the beginning of sw.buf.
 	start := saltSize
-	if isZero(sw.counter) {
+	if sw.isFirstChunk() {
 		// For the first message, include the salt.  Compared to writing the salt
 		// separately, this saves one packet during TCP slow-start and potentially
 		// avoids having a distinctive size for the first packet.
@@ -240,14 +642,160 @@ func (sw *Writer) flush() error {
 	}
 
 	sizeBuf, payloadBuf := sw.buffers()
-	binary.BigEndian.PutUint16(sizeBuf, uint16(sw.pending))
+	sizeField := uint16(sw.pending) | flags
+	binary.BigEndian.PutUint16(sizeBuf, sizeField)
 	sizeBlockSize := sw.encryptBlock(sizeBuf)
+	debugChunk("writer", sw.counter, sizeField)
 	payloadSize := sw.encryptBlock(payloadBuf[:sw.pending])
-	_, err := sw.writer.Write(sw.buf[start : saltSize+sizeBlockSize+payloadSize])
 	sw.pending = 0
+	return sw.buf[start : saltSize+sizeBlockSize+payloadSize], nil
+}
+
+// nonceCounter returns a copy of the little-endian counter that forms the next
+// nonce, or nil before the salt is sent.  It is unexported so that only tests
+// can inspect this key-adjacent state, e.g. to check that a reader and writer
+// advance in lockstep.
+func (sw *Writer) nonceCounter() []byte {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return append([]byte(nil), sw.counter...)
+}
+
+// KeepAlive sends an empty chunk, which readers skip, so that NAT mappings for
+// an idle connection don't expire.  If data is queued by LazyWrite, it sends
+// that data instead.  It does nothing before the first write.
+// This method is thread-safe.
+func (sw *Writer) KeepAlive() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.aead == nil {
+		return nil
+	}
+	if sw.needFlush && sw.pending > 0 {
+		return sw.flush()
+	}
+	return sw.sendSideChunk(0, 0)
+}
+
+// sendSideChunk sends a chunk that holds none of the pending data, with
+// `flags` set in the size field.  If `flags` includes paddedChunkFlag, the
+// payload is `padLen` random bytes followed by the padding length, and
+// otherwise it is empty.  sw.mu must be held.
+func (sw *Writer) sendSideChunk(flags uint16, padLen int) error {
+	if sw.nonceExhausted {
+		return ErrNonceExhausted
+	}
+	saltSize := sw.ssCipher.SaltSize()
+	overhead := sw.aead.Overhead()
+	payloadLen := 0
+	if flags&paddedChunkFlag != 0 {
+		payloadLen = padLen + 2
+	}
+	payloadStart := saltSize + 2 + overhead
+	// A concurrent ReadFrom may be filling payloadBuf, so the chunk is built
+	// in its own buffer.
+	if bufSize := payloadStart + payloadLen + overhead; len(sw.sideBuf) < bufSize {
+		sw.sideBuf = make([]byte, bufSize)
+	}
+	buf := sw.sideBuf
+	start := saltSize
+	if sw.isFirstChunk() {
+		copy(buf, sw.buf[:saltSize])
+		start = 0
+	}
+	if payloadLen > 0 {
+		if _, err := rand.Read(buf[payloadStart : payloadStart+padLen]); err != nil {
+			return &StreamError{Op: "generate padding", Err: err}
+		}
+		binary.BigEndian.PutUint16(buf[payloadStart+padLen:], uint16(padLen))
+	}
+	sizeField := uint16(payloadLen) | flags
+	binary.BigEndian.PutUint16(buf[saltSize:], sizeField)
+	sw.encryptBlock(buf[saltSize : saltSize+2])
+	debugChunk("writer", sw.counter, sizeField)
+	payloadSize := sw.encryptBlock(buf[payloadStart : payloadStart+payloadLen])
+	n, err := sw.writer.Write(buf[start : payloadStart+payloadSize])
+	atomic.AddInt64(&sw.wireBytes, int64(n))
 	return err
 }
 
+// Rekey switches the stream to `newCipher` without closing it, for key rotation
+// on long-lived connections.  Data queued by LazyWrite is sent first, with the
+// old cipher.  Then Rekey sends an empty chunk that has rekeyChunkFlag (0x4000)
+// set in its size field, and the rest of the stream is encrypted as if it were
+// a new stream: a fresh salt followed by chunks with the nonce counter starting
+// again from zero.  On the wire:
+//
+//	[chunks][empty chunk, size field 0x4000][new salt][chunks with new cipher]
+//
+// Each direction of a connection is rekeyed separately, by its own Writer.
+// StreamConn.Rekey rekeys both directions of a client connection: when both
+// ends call it, they exchange rekey chunks and fresh salts.  There is no other
+// handshake, because the new key can't be sent in-band without a key exchange,
+// which Shadowsocks lacks.  Both ends must learn the new key from the
+// application, and the receiving Reader must be told with ExpectRekey (see
+// RekeyingReader) before it reads the rekey chunk.  A Reader only reads the
+// chunk when more data is requested, so an application can, for example,
+// announce the rotation in a message on the stream, and rekey its end when
+// it reads that message.
+//
+// This is an extension to the Shadowsocks protocol: the stream can only be read
+// by a Reader in this package that expects the rekey, and vanilla Shadowsocks
+// servers will fail to decrypt the rest of the stream.  Rekey must not be
+// called concurrently with writes.
+func (sw *Writer) Rekey(newCipher shadowaead.Cipher) error {
+	if err := sw.init(); err != nil {
+		return err
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if err := sw.flush(); err != nil {
+		return err
+	}
+	sw.needFlush = false
+	if err := sw.sendSideChunk(rekeyChunkFlag, 0); err != nil {
+		return err
+	}
+	if sw.originalCipher == nil {
+		sw.originalCipher = sw.ssCipher
+	}
+	sw.ssCipher = newCipher
+	sw.saltGenerator = RandomSaltGenerator
+	sw.aead = nil
+	sw.counter = nil
+	sw.nonceExhausted = false
+	// These are sized for the old cipher.
+	sw.sideBuf = nil
+	sw.vectorBufs = nil
+	return sw.initLocked()
+}
+
+// WireBytes returns the number of bytes written to the inner Writer so far:
+// the salt, and the encrypted size and payload blocks, with their tags.
+// Comparing it with the plaintext byte count shows the protocol overhead.
+// This method is thread-safe.
+func (sw *Writer) WireBytes() int64 {
+	return atomic.LoadInt64(&sw.wireBytes)
+}
+
+// Overhead returns the size of the AEAD tag on each size and payload block,
+// or -1 if the salt has not been written yet.
+func (sw *Writer) Overhead() int {
+	if sw.aead == nil {
+		return -1
+	}
+	return sw.aead.Overhead()
+}
+
+// NonceSize returns the AEAD nonce size, or -1 if the salt has not been
+// written yet.
+func (sw *Writer) NonceSize() int {
+	if sw.aead == nil {
+		return -1
+	}
+	return sw.aead.NonceSize()
+}
+
 // ChunkReader is similar to io.Reader, except that it controls its own
 // buffer granularity.
 type ChunkReader interface {
@@ -260,11 +808,35 @@ type ChunkReader interface {
 type chunkReader struct {
 	reader   io.Reader
 	ssCipher shadowaead.Cipher
+	// If true, chunks marked with paddedChunkFlag have their padding removed.
+	padded bool
+	// Starting value of counter, for testing.  If nil, the counter starts at zero.
+	initialCounter []byte
+	// If positive, an authentication failure on the first chunk is delayed by
+	// up to this long.  See NewProbeResistantShadowsocksReader.
+	maxProbeDelay time.Duration
+	// If positive, chunks with a larger payload are rejected, and the chunk
+	// buffer is only this large.  See NewBoundedShadowsocksReader.
+	maxChunkSize int
+	// Indicates that a message has been successfully decrypted.
+	authenticated bool
+	// rekeyMu protects nextCipher, which is the cipher to switch to at the next
+	// rekey chunk, or nil if rekey chunks are not expected.
+	rekeyMu    sync.Mutex
+	nextCipher shadowaead.Cipher
+	// The cipher before the first rekey chunk, which reset restores, or nil if
+	// the stream has not been rekeyed.
+	originalCipher shadowaead.Cipher
 	// These are lazily initialized:
 	aead cipher.AEAD
 	// Index of the next encrypted chunk to read.
 	counter []byte
-	buf     []byte
+	// Holds the encrypted size block.
+	sizeBuf []byte
+	// Holds the payload.  It is only allocated once a size block has been
+	// authenticated, so that probes and streams that end after the salt don't
+	// cost a full chunk buffer.
+	buf []byte
 }
 
 // Reader is an io.Reader that also implements io.WriterTo to
@@ -272,6 +844,39 @@ type chunkReader struct {
 type Reader interface {
 	io.Reader
 	io.WriterTo
+	// Reset discards the Reader's state, including any buffered plaintext, and
+	// makes it read a new stream, starting with the salt, from `reader`.
+	// The chunk buffer is kept for reuse.  The cipher reverts to the one from
+	// before any rekey, and a pending ExpectRekey is cancelled.
+	Reset(reader io.Reader)
+	// Overhead returns the size of the AEAD tag on each size and payload block,
+	// or -1 if the salt has not been read yet.
+	Overhead() int
+	// NonceSize returns the AEAD nonce size, or -1 if the salt has not been
+	// read yet.
+	NonceSize() int
+	// Peek returns up to `n` bytes of the next plaintext without consuming
+	// them, so that a following Read or WriteTo still returns them.  If no
+	// plaintext is buffered, Peek reads the next non-empty chunk, and it never
+	// reads past that chunk, so it may return fewer than `n` bytes even if more
+	// data follows.  The slice is only valid until the next call on the
+	// Reader, and must not be modified.
+	Peek(n int) ([]byte, error)
+	// Skip decrypts and discards the next `n` bytes of plaintext, without
+	// copying them, and returns the number of bytes discarded.  If the stream
+	// ends first, it returns io.EOF.
+	Skip(n int64) (int64, error)
+}
+
+// RekeyingReader is a Reader that can follow a Writer.Rekey.  The Readers
+// created by this package implement it.
+type RekeyingReader interface {
+	Reader
+	// ExpectRekey makes the Reader switch to `newCipher` at the next rekey
+	// chunk sent by Writer.Rekey.  It must be called before the rekey chunk
+	// is read, and may be called concurrently with reads.  A rekey chunk that
+	// isn't expected fails the read.
+	ExpectRekey(newCipher shadowaead.Cipher) error
 }
 
 // NewShadowsocksReader creates a Reader that decrypts the given Reader using
@@ -282,27 +887,210 @@ func NewShadowsocksReader(reader io.Reader, ssCipher shadowaead.Cipher) Reader {
 	}
 }
 
+// NewShadowsocksReaderWithPrefix is like NewShadowsocksReader, but the stream
+// starts with `prefix`, which holds data that was already read from `reader`,
+// such as a salt and first chunk that arrived in the same packet.
+func NewShadowsocksReaderWithPrefix(reader io.Reader, ssCipher shadowaead.Cipher, prefix []byte) Reader {
+	return NewShadowsocksReader(io.MultiReader(bytes.NewReader(prefix), reader), ssCipher)
+}
+
+// ErrShortSalt is returned by a Reader when the stream ends after some, but not
+// all, of the salt has been received.  This is typical of a malformed handshake
+// or a probe, as opposed to a client that disconnects without sending anything,
+// which results in io.EOF.  The underlying error is available via errors.Unwrap.
+var ErrShortSalt = errors.New("stream ended before the full salt was received")
+
+type shortSaltError struct {
+	cause error
+}
+
+func (e *shortSaltError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrShortSalt, e.cause)
+}
+
+func (e *shortSaltError) Is(target error) bool {
+	return target == ErrShortSalt
+}
+
+func (e *shortSaltError) Unwrap() error {
+	return e.cause
+}
+
+// ErrTruncatedChunk is returned by a Reader when the stream ends after the size
+// block of a chunk, but before the end of its payload.  All data before that
+// chunk has already been returned intact, so a caller can tell a connection cut
+// mid-chunk apart from a corrupted stream.  The underlying error is
+// io.ErrUnexpectedEOF, which is available via errors.Unwrap.
+var ErrTruncatedChunk = errors.New("stream ended in the middle of a chunk")
+
+type truncatedChunkError struct {
+	cause error
+}
+
+func (e *truncatedChunkError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTruncatedChunk, e.cause)
+}
+
+func (e *truncatedChunkError) Is(target error) bool {
+	return target == ErrTruncatedChunk
+}
+
+func (e *truncatedChunkError) Unwrap() error {
+	return e.cause
+}
+
+// NewPaddedShadowsocksReader is like NewShadowsocksReader, but it also
+// understands padded chunks, such as the final chunk written by a Writer
+// configured with SetPadLastChunk, and removes their padding.
+func NewPaddedShadowsocksReader(reader io.Reader, ssCipher shadowaead.Cipher) Reader {
+	return &readConverter{
+		cr: &chunkReader{reader: reader, ssCipher: ssCipher, padded: true},
+	}
+}
+
+// reset points cr at a new stream, keeping only its buffer.  The cipher
+// reverts to the one from before any rekey, and no rekey is expected.
+func (cr *chunkReader) reset(reader io.Reader) {
+	if cr.originalCipher != nil {
+		cr.ssCipher = cr.originalCipher
+		cr.originalCipher = nil
+	}
+	cr.rekeyMu.Lock()
+	cr.nextCipher = nil
+	cr.rekeyMu.Unlock()
+	cr.reader = reader
+	cr.aead = nil
+	cr.counter = nil
+	cr.authenticated = false
+}
+
+// NewProbeResistantShadowsocksReader is like NewShadowsocksReader, but if the first
+// chunk fails authentication, as happens with a wrong key or an active probe, the
+// Reader keeps reading and discarding input for a random time between
+// maxDelay/2 and maxDelay before returning the error.  This hides how quickly the
+// data was rejected, which could otherwise help to identify a Shadowsocks server.
+// Legitimate streams are not delayed.
+//
+// The input is discarded on the reading goroutine, and the Reader never changes
+// the inner Reader's deadlines.  A Read that blocks past the end of the delay
+// also delays the error, so a caller reading from a net.Conn should set a read
+// deadline to bound how long a silent peer can hold the Reader.  Either way,
+// the stream can't be read further, so the caller should close the connection.
+func NewProbeResistantShadowsocksReader(reader io.Reader, ssCipher shadowaead.Cipher, maxDelay time.Duration) Reader {
+	return &readConverter{
+		cr: &chunkReader{reader: reader, ssCipher: ssCipher, maxProbeDelay: maxDelay},
+	}
+}
+
+// ErrChunkTooLarge is returned by a Reader created with NewBoundedShadowsocksReader
+// when a chunk's size field exceeds the Reader's limit.  It is wrapped in a
+// StreamError.
+var ErrChunkTooLarge = errors.New("chunk exceeds the maximum size")
+
+// NewBoundedShadowsocksReader is like NewShadowsocksReader, but it rejects any
+// chunk whose payload is larger than `maxChunkSize` with ErrChunkTooLarge.  This
+// caps the Reader's buffer at `maxChunkSize` plus the tag size, instead of the
+// protocol maximum of 16 KiB, for memory-sensitive embedders whose peers only
+// send small chunks.  A `maxChunkSize` of 0 or more than 16 KiB - 1 is the
+// protocol maximum.
+func NewBoundedShadowsocksReader(reader io.Reader, ssCipher shadowaead.Cipher, maxChunkSize int) Reader {
+	if maxChunkSize >= payloadSizeMask {
+		maxChunkSize = 0
+	}
+	return &readConverter{
+		cr: &chunkReader{reader: reader, ssCipher: ssCipher, maxChunkSize: maxChunkSize},
+	}
+}
+
+// absorbProbe discards input from the inner Reader for a random delay, as if
+// the data were being processed normally.  It doesn't touch the inner Reader's
+// deadlines, so a Read that blocks past the delay also delays the return.
+func (cr *chunkReader) absorbProbe() {
+	delay := cr.maxProbeDelay/2 + time.Duration(mrand.Int63n(int64(cr.maxProbeDelay/2)+1))
+	deadline := time.Now().Add(delay)
+	buf := make([]byte, 512)
+	for time.Now().Before(deadline) {
+		if _, err := cr.reader.Read(buf); err != nil {
+			break
+		}
+	}
+	// If the input ended early, wait out the rest of the delay.
+	time.Sleep(time.Until(deadline))
+}
+
 // init reads the salt from the inner Reader and sets up the AEAD object
 func (cr *chunkReader) init() (err error) {
 	if cr.aead == nil {
 		// For chacha20-poly1305, SaltSize is 32, NonceSize is 12 and Overhead is 16.
 		salt := make([]byte, cr.ssCipher.SaltSize())
 		if _, err := io.ReadFull(cr.reader, salt); err != nil {
-			if err != io.EOF && err != io.ErrUnexpectedEOF {
-				err = fmt.Errorf("failed to read salt: %v", err)
+			switch err {
+			case io.EOF:
+				// The stream closed before sending anything.  Report it as-is.
+			case io.ErrUnexpectedEOF:
+				err = &shortSaltError{cause: err}
+			default:
+				if !isTimeout(err) {
+					err = &StreamError{Op: "read salt", Err: err}
+				}
 			}
 			return err
 		}
 		cr.aead, err = cr.ssCipher.Decrypter(salt)
 		if err != nil {
-			return fmt.Errorf("failed to create AEAD: %v", err)
+			return &StreamError{Op: "create AEAD", Err: err}
 		}
+		debugSalt("reader", salt, cr.aead)
 		cr.counter = make([]byte, cr.aead.NonceSize())
-		cr.buf = make([]byte, payloadSizeMask+cr.aead.Overhead())
+		copy(cr.counter, cr.initialCounter)
+		if sizeBufSize := 2 + cr.aead.Overhead(); len(cr.sizeBuf) != sizeBufSize {
+			cr.sizeBuf = make([]byte, sizeBufSize)
+		}
 	}
 	return nil
 }
 
+// bufferSize returns the size of the chunk buffer, which holds the largest
+// allowed payload and its tag.  The size block has its own buffer.  cr.init()
+// must have been called.
+func (cr *chunkReader) bufferSize() int {
+	if cr.maxChunkSize <= 0 {
+		return payloadSizeMask + cr.aead.Overhead()
+	}
+	return cr.maxChunkSize + cr.aead.Overhead()
+}
+
+// chunkBufferSize is the size of a Reader's chunk buffer for the largest payload
+// and a 16-byte tag, which all the supported ciphers use.
+const chunkBufferSize = payloadSizeMask + 16
+
+// chunkBufferPool holds the chunk buffers of Readers whose stream has ended, so
+// that a relay copying many short streams doesn't allocate one per stream.
+var chunkBufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, chunkBufferSize)
+	},
+}
+
+// releaseBuffer returns cr.buf to chunkBufferPool.  The caller must be done
+// with any payload returned by ReadChunk.  A later read takes a new buffer.
+func (cr *chunkReader) releaseBuffer() {
+	if len(cr.buf) == chunkBufferSize {
+		chunkBufferPool.Put(cr.buf)
+	}
+	cr.buf = nil
+}
+
+// isTimeout reports whether err is a deadline error from the underlying
+// connection.  These errors are returned unwrapped, so that os.IsTimeout
+// recognizes them.  The stream can be read again after a timeout at a chunk
+// boundary, such as on an idle connection, but not after one that interrupts
+// a chunk.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 // readMessage reads, decrypts, and verifies a single AEAD ciphertext.
 // The ciphertext and tag (i.e. "overhead") must exactly fill `buf`,
 // and the decrypted message will be placed in buf[:len(buf)-overhead].
@@ -315,8 +1103,12 @@ func (cr *chunkReader) readMessage(buf []byte) error {
 	_, err = cr.aead.Open(buf[:0], cr.counter, buf, nil)
 	increment(cr.counter)
 	if err != nil {
+		if cr.maxProbeDelay > 0 && !cr.authenticated {
+			cr.absorbProbe()
+		}
 		return fmt.Errorf("failed to decrypt: %v", err)
 	}
+	cr.authenticated = true
 	return nil
 }
 
@@ -324,30 +1116,104 @@ func (cr *chunkReader) ReadChunk() ([]byte, error) {
 	if err := cr.init(); err != nil {
 		return nil, err
 	}
+	return cr.readChunkInto(nil)
+}
+
+// readChunkInto reads the next chunk and decrypts its payload into the start
+// of `buf`, which must have at least cr.bufferSize() bytes, or into cr.buf if
+// `buf` is nil.  The rest of `buf` is used as scratch space.  cr.init() must
+// have been called.
+func (cr *chunkReader) readChunkInto(buf []byte) ([]byte, error) {
 	// In Shadowsocks-AEAD, each chunk consists of two
 	// encrypted messages.  The first message contains the payload length,
 	// and the second message is the payload.
-	sizeBuf := cr.buf[:2+cr.aead.Overhead()]
+	sizeBuf := cr.sizeBuf
 	if err := cr.readMessage(sizeBuf); err != nil {
-		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			err = fmt.Errorf("failed to read payload size: %v", err)
+		if err != io.EOF && err != io.ErrUnexpectedEOF && !isTimeout(err) {
+			err = &StreamError{Op: "read payload size", Err: err}
 		}
 		return nil, err
 	}
-	size := int(binary.BigEndian.Uint16(sizeBuf) & payloadSizeMask)
+	sizeField := binary.BigEndian.Uint16(sizeBuf)
+	debugChunk("reader", cr.counter, sizeField)
+	size := int(sizeField & payloadSizeMask)
+	if cr.maxChunkSize > 0 && size > cr.maxChunkSize {
+		return nil, &StreamError{Op: "read payload size", Err: fmt.Errorf("%w: %d > %d", ErrChunkTooLarge, size, cr.maxChunkSize)}
+	}
+	if buf == nil {
+		if bufSize := cr.bufferSize(); len(cr.buf) != bufSize {
+			if bufSize == chunkBufferSize {
+				cr.buf = chunkBufferPool.Get().([]byte)
+			} else {
+				cr.buf = make([]byte, bufSize)
+			}
+		}
+		buf = cr.buf
+	}
 	sizeWithTag := size + cr.aead.Overhead()
-	if cap(cr.buf) < sizeWithTag {
+	if cap(buf) < sizeWithTag {
 		// This code is unreachable.
 		return nil, io.ErrShortBuffer
 	}
-	payloadBuf := cr.buf[:sizeWithTag]
+	payloadBuf := buf[:sizeWithTag]
 	if err := cr.readMessage(payloadBuf); err != nil {
-		if err == io.EOF { // EOF is not expected mid-chunk.
-			err = io.ErrUnexpectedEOF
+		if err == io.EOF || err == io.ErrUnexpectedEOF { // EOF is not expected mid-chunk.
+			err = &truncatedChunkError{cause: io.ErrUnexpectedEOF}
+		} else if !isTimeout(err) {
+			err = &StreamError{Op: "read payload", Err: err}
 		}
 		return nil, err
 	}
-	return payloadBuf[:size], nil
+	payload := payloadBuf[:size]
+	if sizeField&rekeyChunkFlag != 0 {
+		newCipher := cr.takeNextCipher()
+		if newCipher == nil {
+			return nil, &StreamError{Op: "rekey", Err: errors.New("unexpected rekey chunk")}
+		}
+		if size != 0 {
+			return nil, &StreamError{Op: "rekey", Err: fmt.Errorf("rekey chunk has a %d-byte payload", size)}
+		}
+		// The rest of the stream is a new stream, starting with the salt.
+		if cr.originalCipher == nil {
+			cr.originalCipher = cr.ssCipher
+		}
+		cr.ssCipher = newCipher
+		cr.aead = nil
+		cr.counter = nil
+		if err := cr.init(); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}
+	if cr.padded && sizeField&paddedChunkFlag != 0 {
+		data, err := removePadding(payload)
+		if err != nil {
+			return nil, &StreamError{Op: "remove padding", Err: err}
+		}
+		return data, nil
+	}
+	return payload, nil
+}
+
+// takeNextCipher returns the cipher set by ExpectRekey, if any, and clears it.
+func (cr *chunkReader) takeNextCipher() shadowaead.Cipher {
+	cr.rekeyMu.Lock()
+	defer cr.rekeyMu.Unlock()
+	newCipher := cr.nextCipher
+	cr.nextCipher = nil
+	return newCipher
+}
+
+// removePadding returns the data in the payload of a padded chunk.
+func removePadding(payload []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("padded chunk is too short: %d bytes", len(payload))
+	}
+	dataEnd := len(payload) - 2 - int(binary.BigEndian.Uint16(payload[len(payload)-2:]))
+	if dataEnd < 0 {
+		return nil, fmt.Errorf("invalid padding in %d-byte chunk", len(payload))
+	}
+	return payload[:dataEnd], nil
 }
 
 // readConverter adapts from ChunkReader, with source-controlled
@@ -357,7 +1223,92 @@ type readConverter struct {
 	leftover []byte
 }
 
+func (c *readConverter) Reset(reader io.Reader) {
+	if cr, ok := c.cr.(*chunkReader); ok {
+		cr.reset(reader)
+	}
+	c.leftover = nil
+}
+
+// nonceCounter is like Writer.nonceCounter, for the reader.
+func (c *readConverter) nonceCounter() []byte {
+	if cr, ok := c.cr.(*chunkReader); ok {
+		return append([]byte(nil), cr.counter...)
+	}
+	return nil
+}
+
+func (c *readConverter) Overhead() int {
+	if cr, ok := c.cr.(*chunkReader); ok && cr.aead != nil {
+		return cr.aead.Overhead()
+	}
+	return -1
+}
+
+func (c *readConverter) NonceSize() int {
+	if cr, ok := c.cr.(*chunkReader); ok && cr.aead != nil {
+		return cr.aead.NonceSize()
+	}
+	return -1
+}
+
+func (c *readConverter) ExpectRekey(newCipher shadowaead.Cipher) error {
+	cr, ok := c.cr.(*chunkReader)
+	if !ok {
+		return errors.New("Reader does not support rekeying")
+	}
+	cr.rekeyMu.Lock()
+	cr.nextCipher = newCipher
+	cr.rekeyMu.Unlock()
+	return nil
+}
+
+func (c *readConverter) Peek(n int) ([]byte, error) {
+	if err := c.ensureLeftover(); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		n = 0
+	} else if n > len(c.leftover) {
+		n = len(c.leftover)
+	}
+	return c.leftover[:n], nil
+}
+
+func (c *readConverter) Skip(n int64) (int64, error) {
+	var skipped int64
+	for skipped < n {
+		if err := c.ensureLeftover(); err != nil {
+			return skipped, err
+		}
+		m := n - skipped
+		if m > int64(len(c.leftover)) {
+			m = int64(len(c.leftover))
+		}
+		c.leftover = c.leftover[m:]
+		skipped += m
+	}
+	return skipped, nil
+}
+
 func (c *readConverter) Read(b []byte) (int, error) {
+	if len(c.leftover) == 0 {
+		// Fast path: if `b` can hold a whole chunk, decrypt into it directly,
+		// avoiding a copy.  This requires the salt to have been read already.
+		if cr, ok := c.cr.(*chunkReader); ok && cr.aead != nil && len(b) >= cr.bufferSize() {
+			for {
+				payload, err := cr.readChunkInto(b)
+				// Skip empty chunks, to avoid returning (0, nil).
+				if len(payload) > 0 || err != nil {
+					return len(payload), err
+				}
+				// After a rekey, the chunks may no longer fit in `b`.
+				if len(b) < cr.bufferSize() {
+					break
+				}
+			}
+		}
+	}
 	if err := c.ensureLeftover(); err != nil {
 		return 0, err
 	}
@@ -370,6 +1321,11 @@ func (c *readConverter) WriteTo(w io.Writer) (written int64, err error) {
 	for {
 		if err = c.ensureLeftover(); err != nil {
 			if err == io.EOF {
+				// The stream is over, and c.leftover is empty, so nothing
+				// refers to the chunk buffer.
+				if cr, ok := c.cr.(*chunkReader); ok {
+					cr.releaseBuffer()
+				}
 				err = nil
 			}
 			return written, err
@@ -384,26 +1340,28 @@ func (c *readConverter) WriteTo(w io.Writer) (written int64, err error) {
 }
 
 // Ensures that c.leftover is nonempty.  If leftover is empty, this method
-// waits for incoming data and decrypts it.
+// waits for incoming data and decrypts it.  Chunks with an empty payload are
+// valid, and are skipped.
 // Returns an error only if c.leftover could not be populated.
 func (c *readConverter) ensureLeftover() error {
-	if len(c.leftover) > 0 {
-		return nil
-	}
-	payload, err := c.cr.ReadChunk()
-	if err != nil {
-		return err
+	for len(c.leftover) == 0 {
+		payload, err := c.cr.ReadChunk()
+		if err != nil {
+			return err
+		}
+		c.leftover = payload
 	}
-	c.leftover = payload
 	return nil
 }
 
 // increment little-endian encoded unsigned integer b. Wrap around on overflow.
-func increment(b []byte) {
+// Returns true if b overflowed, i.e. wrapped around to zero.
+func increment(b []byte) bool {
 	for i := range b {
 		b[i]++
 		if b[i] != 0 {
-			return
+			return false
 		}
 	}
+	return true
 }
@@ -0,0 +1,50 @@
+//go:build ssdebug
+// +build ssdebug
+
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"encoding/hex"
+)
+
+// This file is only built with the ssdebug build tag:
+//
+//   go build -tags ssdebug
+//
+// It logs the salt and nonces of every stream at debug level (enabled in the
+// server by -verbose), to help diagnose interop failures with other Shadowsocks
+// implementations.  The logs allow anyone who also knows
+// the password to decrypt the recorded traffic, and they reveal the framing of
+// every chunk, so binaries built with this tag must never be used in production.
+// The derived subkeys are never logged.
+
+func init() {
+	logger.Warning("Built with the ssdebug tag: stream salts and nonces will be logged. Do not use in production.")
+}
+
+// debugSalt logs the salt that `role` ("writer" or "reader") uses to derive its
+// subkey, and the parameters of the resulting AEAD.
+func debugSalt(role string, salt []byte, aead cipher.AEAD) {
+	logger.Debugf("%v salt=%v nonce_size=%v overhead=%v", role, hex.EncodeToString(salt), aead.NonceSize(), aead.Overhead())
+}
+
+// debugChunk logs the nonce of a chunk's payload block, and the chunk's size
+// field.  The size block uses the previous nonce.
+func debugChunk(role string, nonce []byte, sizeField uint16) {
+	logger.Debugf("%v chunk nonce=%v size_field=%#04x", role, hex.EncodeToString(nonce), sizeField)
+}
@@ -0,0 +1,27 @@
+//go:build !ssdebug
+// +build !ssdebug
+
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import "crypto/cipher"
+
+// Without the ssdebug build tag, the debug hooks are empty, so the compiler
+// removes them.  See stream_debug.go.
+
+func debugSalt(role string, salt []byte, aead cipher.AEAD) {}
+
+func debugChunk(role string, nonce []byte, sizeField uint16) {}
@@ -2,12 +2,18 @@ package shadowsocks
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"os"
 	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
@@ -43,11 +49,106 @@ func TestCipherReaderUnexpectedEOF(t *testing.T) {
 	clientReader := strings.NewReader("short")
 	server := NewShadowsocksReader(clientReader, cipher)
 	_, err := server.Read(make([]byte, 10))
+	if !errors.Is(err, ErrShortSalt) {
+		t.Fatalf("Expected ErrShortSalt, got %v", err)
+	}
+	if errors.Unwrap(err) != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected ErrUnexpectedEOF cause, got %v", errors.Unwrap(err))
+	}
+}
+
+func TestCipherReaderUnexpectedEOFAfterSalt(t *testing.T) {
+	cipher := newTestCipher(t)
+
+	salt := make([]byte, cipher.SaltSize())
+	clientReader := bytes.NewReader(append(salt, 1, 2, 3))
+	server := NewShadowsocksReader(clientReader, cipher)
+	_, err := server.Read(make([]byte, 10))
 	if err != io.ErrUnexpectedEOF {
 		t.Fatalf("Expected ErrUnexpectedEOF, got %v", err)
 	}
 }
 
+// errorReader fails every Read with err.
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(b []byte) (int, error) {
+	return 0, r.err
+}
+
+// errorWriter fails every Write with err.
+type errorWriter struct {
+	err error
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestStreamErrorOps(t *testing.T) {
+	cipher := newTestCipher(t)
+	salt := []byte("12345678901234567890123456789012")
+	ssText, err := encryptBlocks(cipher, salt, [][]byte{[]byte("abc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := ioutil.ReadAll(ssText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(i int) []byte {
+		b := append([]byte(nil), valid...)
+		b[i] ^= 1
+		return b
+	}
+	cause := errors.New("connection reset")
+	for _, tc := range []struct {
+		input io.Reader
+		op    string
+	}{
+		{&errorReader{cause}, "read salt"},
+		{bytes.NewReader(corrupt(len(salt))), "read payload size"},
+		{bytes.NewReader(corrupt(len(valid) - 1)), "read payload"},
+	} {
+		_, err := NewShadowsocksReader(tc.input, cipher).Read(make([]byte, 10))
+		var streamErr *StreamError
+		if !errors.As(err, &streamErr) {
+			t.Errorf("Expected a StreamError for %v, got %v", tc.op, err)
+			continue
+		}
+		if streamErr.Op != tc.op {
+			t.Errorf("Wrong Op %q, expected %q", streamErr.Op, tc.op)
+		}
+	}
+
+	writer := NewShadowsocksWriter(ioutil.Discard, cipher)
+	_, err = writer.ReadFrom(&errorReader{cause})
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Op != "read payload" {
+		t.Errorf("Expected a read payload StreamError, got %v", err)
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("StreamError should wrap its cause, got %v", err)
+	}
+
+	// Failures to send are write errors, whether the payload comes from Write
+	// or ReadFrom.
+	writer = NewShadowsocksWriter(&errorWriter{cause}, cipher)
+	_, err = writer.Write([]byte{1})
+	if !errors.As(err, &streamErr) || streamErr.Op != "write payload" {
+		t.Errorf("Expected a write payload StreamError, got %v", err)
+	}
+	_, err = writer.ReadFrom(bytes.NewReader([]byte{1}))
+	if !errors.As(err, &streamErr) || streamErr.Op != "write payload" {
+		t.Errorf("Expected a write payload StreamError, got %v", err)
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("StreamError should wrap its cause, got %v", err)
+	}
+}
+
 func TestCipherReaderEOF(t *testing.T) {
 	cipher := newTestCipher(t)
 
@@ -88,6 +189,143 @@ func encryptBlocks(cipher shadowaead.Cipher, salt []byte, blocks [][]byte) (io.R
 	return &ssText, nil
 }
 
+func TestCipherReaderEmptyChunk(t *testing.T) {
+	cipher := newTestCipher(t)
+	salt := []byte("12345678901234567890123456789012")
+	for _, bufSize := range []int{10, payloadSizeMask + testCipherOverhead} {
+		ssText, err := encryptBlocks(cipher, salt, [][]byte{
+			[]byte("abc"),
+			[]byte{},
+			[]byte{},
+			[]byte("def"),
+			[]byte{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := NewShadowsocksReader(ssText, cipher)
+		buf := make([]byte, bufSize)
+		var got []byte
+		for {
+			n, err := reader.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if n == 0 {
+				t.Fatalf("Read returned (0, nil) with a %d-byte buffer", bufSize)
+			}
+			got = append(got, buf[:n]...)
+		}
+		if string(got) != "abcdef" {
+			t.Errorf("Wrong content with a %d-byte buffer: %q", bufSize, got)
+		}
+	}
+}
+
+func TestCipherReaderEmptyChunkWriteTo(t *testing.T) {
+	cipher := newTestCipher(t)
+	salt := []byte("12345678901234567890123456789012")
+	ssText, err := encryptBlocks(cipher, salt, [][]byte{[]byte{}, []byte("abc"), []byte{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := NewShadowsocksReader(ssText, cipher).WriteTo(&out); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if out.String() != "abc" {
+		t.Errorf("Wrong content: %q", out.String())
+	}
+}
+
+func TestCipherReaderWriteToReleasesBuffer(t *testing.T) {
+	cipher := newTestCipher(t)
+	salt := []byte("12345678901234567890123456789012")
+	ssText, err := encryptBlocks(cipher, salt, [][]byte{[]byte("abc"), []byte("def")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := ioutil.ReadAll(ssText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewShadowsocksReader(bytes.NewReader(full), cipher)
+	var out bytes.Buffer
+	if _, err := reader.WriteTo(&out); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if out.String() != "abcdef" {
+		t.Errorf("Wrong content: %q", out.String())
+	}
+	if buf := reader.(*readConverter).cr.(*chunkReader).buf; buf != nil {
+		t.Error("The chunk buffer was kept after the end of the stream")
+	}
+	// The Reader takes a new buffer for the next stream.
+	reader.Reset(bytes.NewReader(full))
+	out.Reset()
+	if _, err := reader.WriteTo(&out); err != nil {
+		t.Fatalf("WriteTo failed after Reset: %v", err)
+	}
+	if out.String() != "abcdef" {
+		t.Errorf("Wrong content after Reset: %q", out.String())
+	}
+}
+
+func TestCipherReaderTruncatedChunkWriteTo(t *testing.T) {
+	cipher := newTestCipher(t)
+	salt := []byte("12345678901234567890123456789012")
+	ssText, err := encryptBlocks(cipher, salt, [][]byte{[]byte("abc"), []byte("defgh")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := ioutil.ReadAll(ssText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut the stream in the middle of the second chunk's payload.
+	truncated := full[:len(full)-testCipherOverhead-2]
+	var out bytes.Buffer
+	n, err := NewShadowsocksReader(bytes.NewReader(truncated), cipher).WriteTo(&out)
+	if !errors.Is(err, ErrTruncatedChunk) {
+		t.Fatalf("Expected ErrTruncatedChunk, got %v", err)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected ErrUnexpectedEOF cause, got %v", errors.Unwrap(err))
+	}
+	if n != 3 || out.String() != "abc" {
+		t.Errorf("Wrong content before the truncated chunk: %d, %q", n, out.String())
+	}
+}
+
+func TestWriterSkipsEmptyReads(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	// A Reader may return (0, nil).  This must not produce an empty chunk.
+	if _, err := writer.ReadFrom(io.MultiReader(&emptyReader{count: 3}, strings.NewReader("abc"))); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if buf.Len() != cipher.SaltSize()+2+testCipherOverhead+3+testCipherOverhead {
+		t.Errorf("Unexpected stream length %d", buf.Len())
+	}
+}
+
+// emptyReader returns (0, nil) `count` times, then io.EOF.
+type emptyReader struct {
+	count int
+}
+
+func (r *emptyReader) Read(b []byte) (int, error) {
+	if r.count == 0 {
+		return 0, io.EOF
+	}
+	r.count--
+	return 0, nil
+}
+
 func TestCipherReaderGoodReads(t *testing.T) {
 	cipher := newTestCipher(t)
 
@@ -413,3 +651,1538 @@ func TestLazyWriteConcurrentFlush(t *testing.T) {
 		t.Errorf("Wrong final content: %v", decrypted)
 	}
 }
+
+func TestWriteBuffer(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	writer.SetWriteBuffer(100)
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		data := MakeTestPayload(5)
+		expected = append(expected, data...)
+		if _, err := writer.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Buffered writes were sent early: %d bytes", buf.Len())
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	// All the writes share a single chunk.
+	expectedLen := cipher.SaltSize() + 2 + testCipherOverhead + 50 + testCipherOverhead
+	if buf.Len() != expectedLen {
+		t.Errorf("Wrong stream length: %d != %d", buf.Len(), expectedLen)
+	}
+
+	// A write that overflows the buffer sends a full chunk and queues the rest.
+	data := MakeTestPayload(150)
+	expected = append(expected, data...)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	expectedLen += 2 + testCipherOverhead + 100 + testCipherOverhead
+	if buf.Len() != expectedLen {
+		t.Errorf("Wrong stream length: %d != %d", buf.Len(), expectedLen)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reader := NewShadowsocksReader(buf, cipher)
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, expected) {
+		t.Errorf("Wrong final content: %v", decrypted)
+	}
+}
+
+func TestReset(t *testing.T) {
+	cipher := newTestCipher(t)
+	var streams [2]bytes.Buffer
+	var salts [2][]byte
+	writer := NewShadowsocksWriter(&streams[0], cipher)
+	reader := NewShadowsocksReader(&streams[0], cipher)
+	for i := range streams {
+		if i > 0 {
+			writer.Reset(&streams[i])
+			reader.Reset(&streams[i])
+		}
+		expected := MakeTestPayload(100 + i)
+		if _, err := writer.Write(expected); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		// Each stream starts with its own salt.
+		if streams[i].Len() != cipher.SaltSize()+2+testCipherOverhead+len(expected)+testCipherOverhead {
+			t.Errorf("Wrong length for stream %d: %d", i, streams[i].Len())
+		}
+		salts[i] = append([]byte(nil), streams[i].Bytes()[:cipher.SaltSize()]...)
+		decrypted, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(decrypted, expected) {
+			t.Errorf("Wrong content for stream %d: %v", i, decrypted)
+		}
+	}
+	if bytes.Equal(salts[0], salts[1]) {
+		t.Error("Salt was reused after Reset")
+	}
+}
+
+func TestResetAfterRekey(t *testing.T) {
+	oldCipher := newTestCipher(t)
+	newCipher, err := shadowaead.AESGCM([]byte("1234567890123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var streams [2]bytes.Buffer
+	writer := NewShadowsocksWriter(&streams[0], oldCipher)
+	if _, err := writer.Write([]byte("abc")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := writer.Rekey(newCipher); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if _, err := writer.Write([]byte("def")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reader := NewShadowsocksReader(&streams[0], oldCipher).(RekeyingReader)
+	if err := reader.ExpectRekey(newCipher); err != nil {
+		t.Fatalf("ExpectRekey failed: %v", err)
+	}
+	if decrypted, err := ioutil.ReadAll(reader); err != nil || string(decrypted) != "abcdef" {
+		t.Fatalf("Failed to read the rekeyed stream: %q, %v", decrypted, err)
+	}
+
+	// After Reset, both ends use the original cipher again, like fresh ones.
+	writer.Reset(&streams[1])
+	if _, err := writer.Write([]byte("ghi")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if streams[1].Len() != oldCipher.SaltSize()+2+testCipherOverhead+3+testCipherOverhead {
+		t.Errorf("Wrong length for the reset stream: %d", streams[1].Len())
+	}
+	fresh := NewShadowsocksReader(bytes.NewReader(streams[1].Bytes()), oldCipher)
+	if decrypted, err := ioutil.ReadAll(fresh); err != nil || string(decrypted) != "ghi" {
+		t.Errorf("Fresh Reader failed to read the reset stream: %q, %v", decrypted, err)
+	}
+	reader.Reset(&streams[1])
+	if decrypted, err := ioutil.ReadAll(reader); err != nil || string(decrypted) != "ghi" {
+		t.Errorf("Reset Reader failed to read the reset stream: %q, %v", decrypted, err)
+	}
+}
+
+func TestResetCancelsExpectRekey(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	if _, err := writer.Write([]byte("abc")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := writer.Rekey(cipher); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	reader := NewShadowsocksReader(nil, cipher).(RekeyingReader)
+	if err := reader.ExpectRekey(cipher); err != nil {
+		t.Fatalf("ExpectRekey failed: %v", err)
+	}
+	reader.Reset(buf)
+	_, err := ioutil.ReadAll(reader)
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Op != "rekey" {
+		t.Errorf("Expected an unexpected rekey error, got %v", err)
+	}
+}
+
+func TestResetDiscardsPending(t *testing.T) {
+	cipher := newTestCipher(t)
+	writer := NewShadowsocksWriter(ioutil.Discard, cipher)
+	if _, err := writer.LazyWrite([]byte("stale")); err != nil {
+		t.Fatalf("LazyWrite failed: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	writer.Reset(buf)
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Pending data survived Reset: %d bytes", buf.Len())
+	}
+}
+
+func TestReaderTimeout(t *testing.T) {
+	cipher := newTestCipher(t)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	reader := NewShadowsocksReader(serverConn, cipher)
+	buf := make([]byte, 100)
+
+	// Idle before the salt.
+	serverConn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := reader.Read(buf); !os.IsTimeout(err) {
+		t.Fatalf("Expected timeout before salt, got %v", err)
+	}
+
+	expected := MakeTestPayload(10)
+	go NewShadowsocksWriter(clientConn, cipher).Write(expected)
+	serverConn.SetReadDeadline(time.Time{})
+	n, err := reader.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], expected) {
+		t.Errorf("Wrong content: %v", buf[:n])
+	}
+
+	// Idle between chunks.
+	serverConn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := reader.Read(buf); !os.IsTimeout(err) {
+		t.Fatalf("Expected timeout between chunks, got %v", err)
+	}
+}
+
+func TestWriterReadFromReader(t *testing.T) {
+	cipher := newTestCipher(t)
+	data := MakeTestPayload(3*payloadSizeMask + 100)
+	upstream := new(bytes.Buffer)
+	if _, err := NewShadowsocksWriter(upstream, cipher).Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	relayed := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(relayed, cipher)
+	if _, err := writer.ReadFrom(NewShadowsocksReader(upstream, cipher)); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	decrypted, err := ioutil.ReadAll(NewShadowsocksReader(relayed, cipher))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Error("Wrong relayed content")
+	}
+}
+
+// fixedSaltGenerator always returns the same salt.
+type fixedSaltGenerator []byte
+
+func (sg fixedSaltGenerator) GetSalt(salt []byte) error {
+	copy(salt, sg)
+	return nil
+}
+
+// offsetNonceAEAD adds `offset` to each nonce, as a little-endian integer,
+// so that a counter starting at zero behaves like one starting at `offset`.
+type offsetNonceAEAD struct {
+	cipher.AEAD
+	offset []byte
+}
+
+func (a *offsetNonceAEAD) addOffset(nonce []byte) []byte {
+	sum := make([]byte, len(nonce))
+	carry := 0
+	for i := range nonce {
+		v := int(nonce[i]) + int(a.offset[i]) + carry
+		sum[i] = byte(v)
+		carry = v >> 8
+	}
+	return sum
+}
+
+func (a *offsetNonceAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	return a.AEAD.Seal(dst, a.addOffset(nonce), plaintext, additionalData)
+}
+
+// Compares the Writer's output with the reference implementation in
+// go-shadowsocks2, which always starts the nonce at zero.
+func TestWriterReferenceVector(t *testing.T) {
+	cipher := newTestCipher(t)
+	salt := []byte("12345678901234567890123456789012")
+	data := MakeTestPayload(3 * payloadSizeMask)
+	initialCounter := make([]byte, chacha20poly1305.NonceSize)
+	initialCounter[0] = 0xfe // Exercise the carry.
+	initialCounter[5] = 7
+	for _, counter := range [][]byte{nil, initialCounter} {
+		aead, err := cipher.Encrypter(salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counter != nil {
+			aead = &offsetNonceAEAD{AEAD: aead, offset: counter}
+		}
+		expected := bytes.NewBuffer(append([]byte(nil), salt...))
+		if _, err := shadowaead.NewWriter(expected, aead).Write(data); err != nil {
+			t.Fatalf("Reference Write failed: %v", err)
+		}
+
+		actual := new(bytes.Buffer)
+		writer := NewShadowsocksWriter(actual, cipher)
+		writer.SetSaltGenerator(fixedSaltGenerator(salt))
+		writer.initialCounter = counter
+		if _, err := writer.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if !bytes.Equal(actual.Bytes(), expected.Bytes()) {
+			t.Errorf("Ciphertext differs from the reference with initial counter %v", counter)
+		}
+
+		reader := NewShadowsocksReader(expected, cipher)
+		reader.(*readConverter).cr.(*chunkReader).initialCounter = counter
+		decrypted, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Read failed with initial counter %v: %v", counter, err)
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("Wrong plaintext with initial counter %v", counter)
+		}
+	}
+}
+
+func TestWireBytes(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	if writer.WireBytes() != 0 {
+		t.Errorf("WireBytes should start at 0, got %d", writer.WireBytes())
+	}
+	payload := 0
+	chunks := 0
+	for _, size := range []int{10, payloadSizeMask + 1, 500} {
+		if _, err := writer.Write(MakeTestPayload(size)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		payload += size
+		chunks += (size + payloadSizeMask - 1) / payloadSizeMask
+		expected := int64(cipher.SaltSize() + payload + chunks*(2+2*testCipherOverhead))
+		if writer.WireBytes() != expected {
+			t.Errorf("Wrong wire count after %d bytes: %d != %d", payload, writer.WireBytes(), expected)
+		}
+	}
+	if writer.WireBytes() != int64(buf.Len()) {
+		t.Errorf("WireBytes %d doesn't match the output length %d", writer.WireBytes(), buf.Len())
+	}
+}
+
+// newTCPPair returns the two ends of a loopback TCP connection.
+func newTCPPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer listener.Close()
+	clientConn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	serverConn, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatalf("AcceptTCP failed: %v", err)
+	}
+	return clientConn, serverConn
+}
+
+func TestVectoredWrite(t *testing.T) {
+	cipher := newTestCipher(t)
+	clientConn, serverConn := newTCPPair(t)
+	defer serverConn.Close()
+	writer := NewShadowsocksWriter(clientConn, cipher)
+	header := []byte{1, 2, 3}
+	// More than one batch of chunks, with a partial last chunk.
+	data := MakeTestPayload((maxVectoredChunks+2)*payloadSizeMask + 10)
+	go func() {
+		defer clientConn.Close()
+		if _, err := writer.LazyWrite(header); err != nil {
+			t.Errorf("LazyWrite failed: %v", err)
+		}
+		n, err := writer.Write(data)
+		if err != nil {
+			t.Errorf("Write failed: %v", err)
+		}
+		if n != len(data) {
+			t.Errorf("Wrote %d bytes, expected %d", n, len(data))
+		}
+	}()
+	wire, err := ioutil.ReadAll(serverConn)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if writer.WireBytes() != int64(len(wire)) {
+		t.Errorf("WireBytes %d doesn't match the output length %d", writer.WireBytes(), len(wire))
+	}
+	decrypted, err := ioutil.ReadAll(NewShadowsocksReader(bytes.NewReader(wire), cipher))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, append(header, data...)) {
+		t.Error("Wrong decrypted content")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	// Nothing to keep alive before the first write.
+	if err := writer.KeepAlive(); err != nil || buf.Len() != 0 {
+		t.Fatalf("KeepAlive before the first write: %v, %d bytes", err, buf.Len())
+	}
+	// Queued data is sent instead of an empty chunk.
+	if _, err := writer.LazyWrite([]byte("abc")); err != nil {
+		t.Fatalf("LazyWrite failed: %v", err)
+	}
+	if err := writer.KeepAlive(); err != nil {
+		t.Fatalf("KeepAlive failed: %v", err)
+	}
+	len1 := buf.Len()
+	if len1 != cipher.SaltSize()+2+testCipherOverhead+3+testCipherOverhead {
+		t.Errorf("Expected the queued data, got %d bytes", len1)
+	}
+	if err := writer.KeepAlive(); err != nil {
+		t.Fatalf("KeepAlive failed: %v", err)
+	}
+	if buf.Len()-len1 != 2+2*testCipherOverhead {
+		t.Errorf("Expected an empty chunk, got %d bytes", buf.Len()-len1)
+	}
+	if _, err := writer.Write([]byte("def")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	decrypted, err := ioutil.ReadAll(NewShadowsocksReader(buf, cipher))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(decrypted) != "abcdef" {
+		t.Errorf("Wrong decrypted content: %q", decrypted)
+	}
+}
+
+func TestKeepAliveFirstChunk(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	// Initialize the writer without sending anything.
+	if _, err := writer.Write(nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := writer.KeepAlive(); err != nil {
+		t.Fatalf("KeepAlive failed: %v", err)
+	}
+	if _, err := writer.Write([]byte("abc")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// The empty chunk carries the salt.
+	decrypted, err := ioutil.ReadAll(NewShadowsocksReader(buf, cipher))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(decrypted) != "abc" {
+		t.Errorf("Wrong decrypted content: %q", decrypted)
+	}
+}
+
+func TestWriterReadFromFillChunks(t *testing.T) {
+	cipher := newTestCipher(t)
+	data := MakeTestPayload(payloadSizeMask + 100)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	writer.SetFillChunks(true)
+	n, err := writer.ReadFrom(iotest.OneByteReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("Expected %v bytes, got %v", len(data), n)
+	}
+	// One full chunk and one with the remainder.
+	expectedLen := cipher.SaltSize() + 2*(2+2*testCipherOverhead) + len(data)
+	if buf.Len() != expectedLen {
+		t.Errorf("Expected %v bytes on the wire, got %v", expectedLen, buf.Len())
+	}
+	decrypted, err := ioutil.ReadAll(NewShadowsocksReader(buf, cipher))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Error("Wrong decrypted content")
+	}
+}
+
+func TestKeepAliveConcurrentReadFrom(t *testing.T) {
+	cipher := newTestCipher(t)
+	clientConn, serverConn := newTCPPair(t)
+	defer serverConn.Close()
+	writer := NewShadowsocksWriter(clientConn, cipher)
+	data := MakeTestPayload(100 * payloadSizeMask)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer clientConn.Close()
+		// ReadFrom reads one small piece at a time.
+		if _, err := writer.ReadFrom(iotest.OneByteReader(bytes.NewReader(data[:1000]))); err != nil {
+			t.Errorf("ReadFrom failed: %v", err)
+		}
+		if _, err := writer.ReadFrom(bytes.NewReader(data[1000:])); err != nil {
+			t.Errorf("ReadFrom failed: %v", err)
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				writer.KeepAlive()
+			}
+		}
+	}()
+	decrypted, err := ioutil.ReadAll(NewShadowsocksReader(serverConn, cipher))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Error("Wrong decrypted content")
+	}
+}
+
+func TestNonceCountersLockstep(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	reader := NewShadowsocksReader(buf, cipher).(*readConverter)
+	if writer.nonceCounter() != nil || reader.nonceCounter() != nil {
+		t.Error("Counters should be nil before the salt")
+	}
+	for i := 0; i < 5; i++ {
+		payload := MakeTestPayload(10 * (i + 1))
+		if _, err := writer.Write(payload); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if _, err := io.ReadFull(reader, make([]byte, len(payload))); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		writerCounter, readerCounter := writer.nonceCounter(), reader.nonceCounter()
+		if !bytes.Equal(writerCounter, readerCounter) {
+			t.Fatalf("Counters diverged after chunk %d: %x != %x", i, writerCounter, readerCounter)
+		}
+		// Each chunk uses two nonces.
+		if expected := byte(2 * (i + 1)); writerCounter[0] != expected {
+			t.Errorf("Counter is %x after chunk %d", writerCounter, i)
+		}
+	}
+}
+
+func TestOverheadAndNonceSize(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	if writer.Overhead() != -1 || writer.NonceSize() != -1 {
+		t.Errorf("Expected -1 before init, got %d and %d", writer.Overhead(), writer.NonceSize())
+	}
+	if _, err := writer.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if writer.Overhead() != testCipherOverhead {
+		t.Errorf("Wrong writer overhead %d", writer.Overhead())
+	}
+	if writer.NonceSize() != 12 {
+		t.Errorf("Wrong writer nonce size %d", writer.NonceSize())
+	}
+
+	reader := NewShadowsocksReader(buf, cipher)
+	if reader.Overhead() != -1 || reader.NonceSize() != -1 {
+		t.Errorf("Expected -1 before init, got %d and %d", reader.Overhead(), reader.NonceSize())
+	}
+	if _, err := reader.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if reader.Overhead() != testCipherOverhead {
+		t.Errorf("Wrong reader overhead %d", reader.Overhead())
+	}
+	if reader.NonceSize() != 12 {
+		t.Errorf("Wrong reader nonce size %d", reader.NonceSize())
+	}
+}
+
+func TestProbeResistantReader(t *testing.T) {
+	cipher := newTestCipher(t)
+	const maxDelay = 100 * time.Millisecond
+	// A probe: random bytes that fail authentication.
+	probe := bytes.NewReader(MakeTestPayload(1000))
+	reader := NewProbeResistantShadowsocksReader(probe, cipher, maxDelay)
+	start := time.Now()
+	if _, err := reader.Read(make([]byte, 100)); err == nil {
+		t.Fatal("Expected an authentication error")
+	}
+	if elapsed := time.Since(start); elapsed < maxDelay/2 {
+		t.Errorf("Error was returned after only %v", elapsed)
+	}
+
+	// Valid streams are not delayed.
+	buf := new(bytes.Buffer)
+	expected := MakeTestPayload(100)
+	if _, err := NewShadowsocksWriter(buf, cipher).Write(expected); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reader = NewProbeResistantShadowsocksReader(buf, cipher, time.Hour)
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, expected) {
+		t.Error("Wrong content")
+	}
+}
+
+func TestProbeResistantReaderConn(t *testing.T) {
+	cipher := newTestCipher(t)
+	const maxDelay = 100 * time.Millisecond
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go clientConn.Write(MakeTestPayload(1000))
+	// The caller bounds how long the client can hold the connection open.
+	serverConn.SetReadDeadline(time.Now().Add(2 * maxDelay))
+	reader := NewProbeResistantShadowsocksReader(serverConn, cipher, maxDelay)
+	start := time.Now()
+	if _, err := reader.Read(make([]byte, 100)); err == nil {
+		t.Fatal("Expected an authentication error")
+	}
+	if elapsed := time.Since(start); elapsed < maxDelay/2 || elapsed > 5*maxDelay {
+		t.Errorf("Error was returned after %v", elapsed)
+	}
+	// Nothing reads the connection after the error.
+	clientConn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := clientConn.Write([]byte{1}); err == nil {
+		t.Error("Input is still being discarded")
+	}
+	// The caller's deadline is still in effect.
+	done := make(chan error, 1)
+	go func() {
+		_, err := serverConn.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("Expected a timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("The caller's read deadline was cleared")
+	}
+}
+
+func TestReaderSkip(t *testing.T) {
+	cipher := newTestCipher(t)
+	salt := []byte("12345678901234567890123456789012")
+	ssText, err := encryptBlocks(cipher, salt, [][]byte{
+		[]byte("abc"),
+		[]byte{},
+		[]byte("def"),
+		[]byte("ghi"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewShadowsocksReader(ssText, cipher)
+	// Skip across a chunk boundary and an empty chunk.
+	if n, err := reader.Skip(4); err != nil || n != 4 {
+		t.Fatalf("Skip returned %v, %v", n, err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(buf) != "efg" {
+		t.Errorf("Expected \"efg\", got %q", buf)
+	}
+	if n, err := reader.Skip(10); err != io.EOF || n != 2 {
+		t.Errorf("Expected 2, EOF at the end of the stream, got %v, %v", n, err)
+	}
+}
+
+func TestReaderWithPrefix(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	expected := MakeTestPayload(100)
+	if _, err := NewShadowsocksWriter(buf, cipher).Write(expected); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	ssText := buf.Bytes()
+	// The prefix ends inside the salt, at the end of the salt, and inside the
+	// first chunk.
+	for _, prefixLen := range []int{10, cipher.SaltSize(), cipher.SaltSize() + 20} {
+		reader := NewShadowsocksReaderWithPrefix(bytes.NewReader(ssText[prefixLen:]), cipher, ssText[:prefixLen])
+		decrypted, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Read failed with a %d-byte prefix: %v", prefixLen, err)
+		}
+		if !bytes.Equal(decrypted, expected) {
+			t.Errorf("Wrong content with a %d-byte prefix", prefixLen)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	oldCipher := newTestCipher(t)
+	// A cipher with a different salt size.
+	newCipher, err := shadowaead.AESGCM([]byte("1234567890123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, oldCipher)
+	if _, err := writer.Write([]byte("abc")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := writer.LazyWrite([]byte("de")); err != nil {
+		t.Fatalf("LazyWrite failed: %v", err)
+	}
+	if err := writer.Rekey(newCipher); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if _, err := writer.Write([]byte("fgh")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := writer.KeepAlive(); err != nil {
+		t.Fatalf("KeepAlive failed: %v", err)
+	}
+	if _, err := writer.Write([]byte("ij")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	ssText := buf.Bytes()
+
+	// Read through the Reader's buffer, and directly into a large buffer.
+	for _, readSize := range []int{1, payloadSizeMask + testCipherOverhead} {
+		reader := NewShadowsocksReader(bytes.NewReader(ssText), oldCipher).(RekeyingReader)
+		if err := reader.ExpectRekey(newCipher); err != nil {
+			t.Fatalf("ExpectRekey failed: %v", err)
+		}
+		var decrypted []byte
+		readBuf := make([]byte, readSize)
+		for {
+			n, err := reader.Read(readBuf)
+			decrypted = append(decrypted, readBuf[:n]...)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+		}
+		if string(decrypted) != "abcdefghij" {
+			t.Errorf("Expected \"abcdefghij\", got %q", decrypted)
+		}
+	}
+
+	// A Reader that doesn't expect the rekey fails at the rekey chunk.
+	decrypted, err := ioutil.ReadAll(NewShadowsocksReader(bytes.NewReader(ssText), oldCipher))
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Op != "rekey" {
+		t.Errorf("Expected a rekey error without ExpectRekey, got %v", err)
+	}
+	if string(decrypted) != "abcde" {
+		t.Errorf("Expected \"abcde\", got %q", decrypted)
+	}
+}
+
+func TestReaderPeek(t *testing.T) {
+	cipher := newTestCipher(t)
+	salt := []byte("12345678901234567890123456789012")
+	ssText, err := encryptBlocks(cipher, salt, [][]byte{
+		[]byte{},
+		[]byte("abc"),
+		[]byte("def"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewShadowsocksReader(ssText, cipher)
+	peeked, err := reader.Peek(2)
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if string(peeked) != "ab" {
+		t.Errorf("Expected \"ab\", got %q", peeked)
+	}
+	// Peek doesn't read past the first non-empty chunk.
+	peeked, err = reader.Peek(10)
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if string(peeked) != "abc" {
+		t.Errorf("Expected \"abc\", got %q", peeked)
+	}
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(decrypted) != "abcdef" {
+		t.Errorf("Expected \"abcdef\", got %q", decrypted)
+	}
+	if _, err := reader.Peek(1); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestReaderBufferAllocatedOnData(t *testing.T) {
+	cipher := newTestCipher(t)
+	// A probe fails authentication on the size block.
+	reader := NewShadowsocksReader(bytes.NewReader(MakeTestPayload(100)), cipher)
+	if _, err := reader.Read(make([]byte, 10)); err == nil {
+		t.Fatal("Expected an authentication error")
+	}
+	if cr := reader.(*readConverter).cr.(*chunkReader); cr.buf != nil {
+		t.Errorf("Chunk buffer was allocated for a probe")
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := NewShadowsocksWriter(buf, cipher).Write([]byte("abc")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reader = NewShadowsocksReader(buf, cipher)
+	if _, err := reader.Read(make([]byte, 10)); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if cr := reader.(*readConverter).cr.(*chunkReader); cr.buf == nil {
+		t.Errorf("Chunk buffer was not allocated for data")
+	}
+}
+
+func TestBoundedReader(t *testing.T) {
+	cipher := newTestCipher(t)
+	salt := []byte("12345678901234567890123456789012")
+	ssText, err := encryptBlocks(cipher, salt, [][]byte{
+		MakeTestPayload(10),
+		MakeTestPayload(11),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewBoundedShadowsocksReader(ssText, cipher, 10)
+	buf := make([]byte, 100)
+	n, err := reader.Read(buf)
+	if err != nil {
+		t.Fatalf("Read of chunk at the limit failed: %v", err)
+	}
+	if n != 10 {
+		t.Fatalf("Expected 10 bytes, got %v", n)
+	}
+	_, err = reader.Read(buf)
+	if !errors.Is(err, ErrChunkTooLarge) {
+		t.Fatalf("Expected ErrChunkTooLarge, got %v", err)
+	}
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) {
+		t.Errorf("Expected a StreamError, got %T", err)
+	}
+}
+
+func TestBoundedReaderMinimum(t *testing.T) {
+	cipher := newTestCipher(t)
+	salt := []byte("12345678901234567890123456789012")
+	payload := MakeTestPayload(1)
+	ssText, err := encryptBlocks(cipher, salt, [][]byte{payload, payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewBoundedShadowsocksReader(ssText, cipher, 1)
+	// A 1-byte buffer is too small to decrypt into, so the chunk buffer is used.
+	buf := make([]byte, 1)
+	for i := 0; i < 2; i++ {
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(buf, payload) {
+			t.Errorf("Expected %v, got %v", payload, buf)
+		}
+	}
+	cr := reader.(*readConverter).cr.(*chunkReader)
+	if expected := 1 + cr.aead.Overhead(); len(cr.buf) != expected {
+		t.Errorf("Expected a %v-byte chunk buffer, got %v", expected, len(cr.buf))
+	}
+}
+
+func TestPadLastChunk(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	const padSize = 100
+	writer.SetPadLastChunk(padSize)
+	data := []byte{1, 2, 3}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	len1 := buf.Len()
+	header := []byte{4, 5}
+	if _, err := writer.LazyWrite(header); err != nil {
+		t.Fatalf("LazyWrite failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	// The final chunk consists of the size block and the padded payload.
+	expectedLen := len1 + 2 + testCipherOverhead + padSize + testCipherOverhead
+	if buf.Len() != expectedLen {
+		t.Errorf("Wrong stream length: %d != %d", buf.Len(), expectedLen)
+	}
+
+	reader := NewPaddedShadowsocksReader(buf, cipher)
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, append(data, header...)) {
+		t.Errorf("Wrong final content: %v", decrypted)
+	}
+}
+
+func TestChunkPadding(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	const padSize = 50
+	writer.SetChunkPadding(func() int { return padSize })
+	data := MakeTestPayload(payloadSizeMask + 100)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// Two data chunks, each followed by a padding chunk.
+	dataLen := cipher.SaltSize() + len(data) + 2*(2+2*testCipherOverhead)
+	paddingLen := 2 * (2 + testCipherOverhead + padSize + 2 + testCipherOverhead)
+	if buf.Len() != dataLen+paddingLen {
+		t.Errorf("Wrong stream length: %d != %d", buf.Len(), dataLen+paddingLen)
+	}
+
+	reader := NewPaddedShadowsocksReader(buf, cipher)
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Error("Wrong decrypted content")
+	}
+}
+
+func TestRandomChunkPadding(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	writer.SetChunkPadding(RandomChunkPadding(payloadSizeMask))
+	var data []byte
+	for i := 0; i < 20; i++ {
+		payload := MakeTestPayload(100 * i)
+		if _, err := writer.Write(payload); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		data = append(data, payload...)
+	}
+	reader := NewPaddedShadowsocksReader(buf, cipher)
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Error("Wrong decrypted content")
+	}
+}
+
+// signalingReader returns `data` on its first Read, but only after `flush`
+// has run, to make the Flush overlap with a ReadFrom that has filled its
+// buffer.
+type signalingReader struct {
+	data  []byte
+	flush func()
+}
+
+func (r *signalingReader) Read(b []byte) (int, error) {
+	if r.data == nil {
+		return 0, io.EOF
+	}
+	n := copy(b, r.data)
+	r.data = nil
+	r.flush()
+	return n, nil
+}
+
+func TestChunkPaddingConcurrentFlush(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	writer.SetChunkPadding(func() int { return payloadSizeMask })
+	header := []byte{1, 2, 3, 4}
+	if _, err := writer.LazyWrite(header); err != nil {
+		t.Fatalf("LazyWrite failed: %v", err)
+	}
+	body := MakeTestPayload(1000)
+	source := &signalingReader{data: body, flush: func() {
+		// Flush on another goroutine, as DialTCP does.
+		done := make(chan error)
+		go func() { done <- writer.Flush() }()
+		if err := <-done; err != nil {
+			t.Errorf("Flush failed: %v", err)
+		}
+	}}
+	if _, err := writer.ReadFrom(source); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+
+	reader := NewPaddedShadowsocksReader(buf, cipher)
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, append(header, body...)) {
+		t.Error("Wrong decrypted content")
+	}
+}
+
+func TestRandomChunkPaddingNegative(t *testing.T) {
+	paddingSize := RandomChunkPadding(-5)
+	for i := 0; i < 10; i++ {
+		if size := paddingSize(); size != 0 {
+			t.Errorf("Expected no padding, got %d", size)
+		}
+	}
+}
+
+func TestPadLastChunkFull(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	writer.SetPadLastChunk(10)
+	// A full buffer leaves no room for the padding length.
+	data := MakeTestPayload(payloadSizeMask)
+	if _, err := writer.LazyWrite(data); err != nil {
+		t.Fatalf("LazyWrite failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reader := NewPaddedShadowsocksReader(buf, cipher)
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Errorf("Wrong final content")
+	}
+}
+
+func TestCloseWithoutPadding(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Close without padding wrote %d bytes", buf.Len())
+	}
+}
+
+func TestReaderDirectRead(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	data := MakeTestPayload(3 * payloadSizeMask)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	reader := NewShadowsocksReader(buf, cipher)
+	// A small first read initializes the reader and leaves some leftover data.
+	decrypted := make([]byte, 10, len(data))
+	if _, err := io.ReadFull(reader, decrypted); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	// Subsequent reads are large enough to take the direct path.
+	readBuf := make([]byte, payloadSizeMask+testCipherOverhead)
+	for {
+		n, err := reader.Read(readBuf)
+		decrypted = append(decrypted, readBuf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Errorf("Wrong final content")
+	}
+}
+
+// sealMaxSizeChunk returns a stream with one chunk whose size field has every
+// bit set, including the ones outside payloadSizeMask.
+func sealMaxSizeChunk(t *testing.T, cipher shadowaead.Cipher) []byte {
+	salt := MakeTestPayload(cipher.SaltSize())
+	aead, err := cipher.Encrypter(salt)
+	if err != nil {
+		t.Fatalf("Failed to create AEAD: %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	stream := aead.Seal(salt, nonce, []byte{0xff, 0xff}, nil)
+	nonce[0]++
+	return aead.Seal(stream, nonce, make([]byte, payloadSizeMask), nil)
+}
+
+// Feeds corrupted and truncated streams to each kind of Reader.  A Reader must
+// never panic or hang, and because every chunk is authenticated, any data it
+// returns must be a prefix of the original plaintext.  Unless the input is the
+// valid stream cut at a chunk boundary, the Reader must also report an error.
+func TestReaderRandomInput(t *testing.T) {
+	cipher := newTestCipher(t)
+	data := MakeTestPayload(payloadSizeMask + 1000)
+	valid := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(valid, cipher)
+	// Chunks of 1, 0, 100, the maximum and the remaining sizes.  `boundaries`
+	// holds the lengths of the valid stream at which a chunk ends.
+	boundaries := map[int]bool{0: true, cipher.SaltSize(): true}
+	for _, chunk := range [][]byte{data[:1], nil, data[1:101], data[101 : 101+payloadSizeMask], data[101+payloadSizeMask:]} {
+		var err error
+		if chunk == nil {
+			err = writer.KeepAlive()
+		} else {
+			_, err = writer.Write(chunk)
+		}
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		boundaries[valid.Len()] = true
+	}
+
+	newReaders := map[string]func(io.Reader) Reader{
+		"plain":   func(r io.Reader) Reader { return NewShadowsocksReader(r, cipher) },
+		"padded":  func(r io.Reader) Reader { return NewPaddedShadowsocksReader(r, cipher) },
+		"bounded": func(r io.Reader) Reader { return NewBoundedShadowsocksReader(r, cipher, 100) },
+	}
+	check := func(name string, newReader func(io.Reader) Reader, input []byte, expectErr bool) {
+		t.Helper()
+		decrypted, err := ioutil.ReadAll(newReader(bytes.NewReader(input)))
+		if !bytes.HasPrefix(data, decrypted) {
+			t.Fatalf("%v: Read returned data that is not in the stream", name)
+		}
+		if expectErr && err == nil {
+			t.Fatalf("%v: Read of an invalid stream of %v bytes succeeded", name, len(input))
+		}
+		var out bytes.Buffer
+		_, err = newReader(bytes.NewReader(input)).WriteTo(&out)
+		if !bytes.HasPrefix(data, out.Bytes()) {
+			t.Fatalf("%v: WriteTo returned data that is not in the stream", name)
+		}
+		if expectErr && err == nil {
+			t.Fatalf("%v: WriteTo of an invalid stream of %v bytes succeeded", name, len(input))
+		}
+	}
+
+	for name, newReader := range newReaders {
+		check(name, newReader, sealMaxSizeChunk(t, cipher), true)
+		if name != "bounded" {
+			for length := range boundaries {
+				decrypted, err := ioutil.ReadAll(newReader(bytes.NewReader(valid.Bytes()[:length])))
+				if err != nil || !bytes.HasPrefix(data, decrypted) {
+					t.Fatalf("%v: Failed to read the valid stream cut at %v bytes: %v", name, length, err)
+				}
+			}
+			decrypted, err := ioutil.ReadAll(newReader(bytes.NewReader(valid.Bytes())))
+			if err != nil || !bytes.Equal(decrypted, data) {
+				t.Fatalf("%v: Failed to read the valid stream: %v", name, err)
+			}
+		}
+	}
+
+	rng := mrand.New(mrand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		input := append([]byte(nil), valid.Bytes()...)
+		switch rng.Intn(4) {
+		case 0:
+			input = input[:rng.Intn(len(input))]
+		case 1:
+			for j := rng.Intn(4); j >= 0; j-- {
+				input[rng.Intn(len(input))] ^= byte(1 << uint(rng.Intn(8)))
+			}
+		case 2:
+			start := rng.Intn(len(input))
+			rng.Read(input[start : start+rng.Intn(len(input)-start)])
+		case 3:
+			input = input[:rng.Intn(100)]
+			rng.Read(input)
+		}
+		// Mutations may cancel out, or cut the stream at a boundary.  Any salt
+		// alone is a valid empty stream.
+		expectErr := !boundaries[len(input)] ||
+			len(input) != cipher.SaltSize() && !bytes.HasPrefix(valid.Bytes(), input)
+		for name, newReader := range newReaders {
+			check(name, newReader, input, expectErr)
+		}
+	}
+}
+
+// Reads a probe: a connection that sends some random bytes and closes.
+func BenchmarkReaderRead_Probe(b *testing.B) {
+	key := []byte("12345678901234567890123456789012")
+	cipher, err := shadowaead.Chacha20Poly1305(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	probe := MakeTestPayload(100)
+	readBuf := make([]byte, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader := NewShadowsocksReader(bytes.NewReader(probe), cipher)
+		if _, err := reader.Read(readBuf); err == nil {
+			b.Fatal("Expected an authentication error")
+		}
+	}
+}
+
+func benchmarkReaderRead(b *testing.B, readSize int) {
+	key := []byte("12345678901234567890123456789012")
+	cipher, err := shadowaead.Chacha20Poly1305(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ciphertext := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(ciphertext, cipher)
+	data := MakeTestPayload(64 * payloadSizeMask)
+	if _, err := writer.Write(data); err != nil {
+		b.Fatalf("Write failed: %v", err)
+	}
+	readBuf := make([]byte, readSize)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader := NewShadowsocksReader(bytes.NewReader(ciphertext.Bytes()), cipher)
+		for {
+			if _, err := reader.Read(readBuf); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatalf("Read failed: %v", err)
+			}
+		}
+	}
+}
+
+// Reads through the reader's own buffer, copying each chunk into the destination.
+func BenchmarkReaderRead_Copy(b *testing.B) {
+	benchmarkReaderRead(b, payloadSizeMask)
+}
+
+// Reads with a destination large enough to decrypt each chunk in place.
+func BenchmarkReaderRead_Direct(b *testing.B) {
+	benchmarkReaderRead(b, payloadSizeMask+testCipherOverhead)
+}
+
+// Relays a stream from a Reader to a Writer with the same cipher, as when
+// chaining proxies.
+func BenchmarkWriterReadFrom_Reader(b *testing.B) {
+	key := []byte("12345678901234567890123456789012")
+	cipher, err := shadowaead.Chacha20Poly1305(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ciphertext := new(bytes.Buffer)
+	data := MakeTestPayload(64 * payloadSizeMask)
+	if _, err := NewShadowsocksWriter(ciphertext, cipher).Write(data); err != nil {
+		b.Fatalf("Write failed: %v", err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader := NewShadowsocksReader(bytes.NewReader(ciphertext.Bytes()), cipher)
+		writer := NewShadowsocksWriter(ioutil.Discard, cipher)
+		if _, err := writer.ReadFrom(reader); err != nil {
+			b.Fatalf("ReadFrom failed: %v", err)
+		}
+	}
+}
+
+// chunkCounter counts the chunks written by a Writer, which writes each chunk
+// in a single call.
+type chunkCounter int
+
+func (c *chunkCounter) Write(p []byte) (int, error) {
+	*c++
+	return len(p), nil
+}
+
+// chattyReader returns at most `size` bytes per Read.
+type chattyReader struct {
+	reader io.Reader
+	size   int
+}
+
+func (r *chattyReader) Read(p []byte) (int, error) {
+	if len(p) > r.size {
+		p = p[:r.size]
+	}
+	return r.reader.Read(p)
+}
+
+// Relays a source that returns 100 bytes per Read, reporting the number of
+// chunks sent with and without SetFillChunks.
+func BenchmarkWriterReadFrom_Chatty(b *testing.B) {
+	key := []byte("12345678901234567890123456789012")
+	cipher, err := shadowaead.Chacha20Poly1305(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := MakeTestPayload(64 * payloadSizeMask)
+	for _, fill := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fill=%v", fill), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			var chunks chunkCounter
+			for i := 0; i < b.N; i++ {
+				writer := NewShadowsocksWriter(&chunks, cipher)
+				writer.SetFillChunks(fill)
+				source := &chattyReader{bytes.NewReader(data), 100}
+				if _, err := writer.ReadFrom(source); err != nil {
+					b.Fatalf("ReadFrom failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(chunks)/float64(b.N), "chunks/op")
+		})
+	}
+}
+
+// BenchmarkRelayCopy measures the io.Copy calls that onet.Relay makes for a
+// connection wrapped with onet.WrapConn, which forwards WriteTo to the Reader
+// and ReadFrom to the Writer, against copies that hide those methods and so go
+// through io.Copy's intermediate buffer.
+func BenchmarkRelayCopy(b *testing.B) {
+	key := []byte("12345678901234567890123456789012")
+	cipher, err := shadowaead.Chacha20Poly1305(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := MakeTestPayload(16 * payloadSizeMask)
+	ciphertext := new(bytes.Buffer)
+	if _, err := NewShadowsocksWriter(ciphertext, cipher).Write(data); err != nil {
+		b.Fatalf("Write failed: %v", err)
+	}
+	// Hides any WriteTo and ReadFrom methods from io.Copy.
+	type plainReader struct{ io.Reader }
+	type plainWriter struct{ io.Writer }
+
+	b.Run("Decrypt_WriterTo", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader := NewShadowsocksReader(bytes.NewReader(ciphertext.Bytes()), cipher)
+			io.Copy(plainWriter{ioutil.Discard}, reader)
+		}
+	})
+	b.Run("Decrypt_Naive", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader := NewShadowsocksReader(bytes.NewReader(ciphertext.Bytes()), cipher)
+			io.Copy(plainWriter{ioutil.Discard}, plainReader{reader})
+		}
+	})
+	b.Run("Encrypt_ReaderFrom", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			writer := NewShadowsocksWriter(ioutil.Discard, cipher)
+			io.Copy(writer, plainReader{bytes.NewReader(data)})
+		}
+	})
+	b.Run("Encrypt_Naive", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			writer := NewShadowsocksWriter(ioutil.Discard, cipher)
+			io.Copy(plainWriter{writer}, plainReader{bytes.NewReader(data)})
+		}
+	})
+}
+
+// BenchmarkStream pipes 16 MiB through a Writer and a Reader, using their
+// ReadFrom and WriteTo methods, as a relay would.
+func BenchmarkStream(b *testing.B) {
+	key := []byte("12345678901234567890123456789012")
+	cipher, err := shadowaead.Chacha20Poly1305(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := MakeTestPayload(16 * 1024 * 1024)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pipeReader, pipeWriter := io.Pipe()
+		go func() {
+			writer := NewShadowsocksWriter(pipeWriter, cipher)
+			_, err := writer.ReadFrom(bytes.NewReader(data))
+			pipeWriter.CloseWithError(err)
+		}()
+		reader := NewShadowsocksReader(pipeReader, cipher)
+		n, err := reader.WriteTo(ioutil.Discard)
+		if err != nil {
+			b.Fatalf("WriteTo failed: %v", err)
+		}
+		if n != int64(len(data)) {
+			b.Fatalf("Expected %v bytes, got %v", len(data), n)
+		}
+	}
+}
+
+// BenchmarkWriterWrite_TCP compares the vectored write of several chunks with
+// a write per chunk.  Hiding the *net.TCPConn type disables vectored writes.
+func BenchmarkWriterWrite_TCP(b *testing.B) {
+	key := []byte("12345678901234567890123456789012")
+	cipher, err := shadowaead.Chacha20Poly1305(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := MakeTestPayload(maxVectoredChunks * payloadSizeMask)
+	for _, vectored := range []bool{true, false} {
+		b.Run(fmt.Sprintf("vectored=%v", vectored), func(b *testing.B) {
+			clientConn, serverConn := newTCPPair(b)
+			defer clientConn.Close()
+			go io.Copy(ioutil.Discard, serverConn)
+			var conn io.Writer = clientConn
+			if !vectored {
+				conn = struct{ io.Writer }{clientConn}
+			}
+			writer := NewShadowsocksWriter(conn, cipher)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := writer.Write(data); err != nil {
+					b.Fatalf("Write failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// insecureAEAD is an insecure cipher.AEAD with configurable sizes, for testing
+// framing.  The tag of each message is the nonce's first byte, repeated.
+type insecureAEAD struct {
+	nonceSize int
+	overhead  int
+}
+
+func (a *insecureAEAD) NonceSize() int {
+	return a.nonceSize
+}
+
+func (a *insecureAEAD) Overhead() int {
+	return a.overhead
+}
+
+func (a *insecureAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	dst = append(dst, plaintext...)
+	for i := 0; i < a.overhead; i++ {
+		dst = append(dst, nonce[0])
+	}
+	return dst
+}
+
+func (a *insecureAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < a.overhead {
+		return nil, errors.New("ciphertext is too short")
+	}
+	plaintextLen := len(ciphertext) - a.overhead
+	for _, v := range ciphertext[plaintextLen:] {
+		if v != nonce[0] {
+			return nil, errors.New("message authentication failed")
+		}
+	}
+	return append(dst, ciphertext[:plaintextLen]...), nil
+}
+
+// insecureCipher is a shadowaead.Cipher that uses insecureAEAD.
+type insecureCipher struct {
+	aead *insecureAEAD
+}
+
+func (c *insecureCipher) KeySize() int {
+	return 16
+}
+
+func (c *insecureCipher) SaltSize() int {
+	return 16
+}
+
+func (c *insecureCipher) Encrypter(salt []byte) (cipher.AEAD, error) {
+	return c.aead, nil
+}
+
+func (c *insecureCipher) Decrypter(salt []byte) (cipher.AEAD, error) {
+	return c.aead, nil
+}
+
+func TestWriterNonceExhausted(t *testing.T) {
+	// A 1-byte nonce allows 256 messages, i.e. 128 chunks.
+	cipher := &insecureCipher{&insecureAEAD{nonceSize: 1, overhead: 1}}
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	for i := 0; i < 128; i++ {
+		if _, err := writer.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+	}
+	len1 := buf.Len()
+	_, err := writer.Write([]byte{0})
+	if !errors.Is(err, ErrNonceExhausted) {
+		t.Errorf("Expected ErrNonceExhausted, got %v", err)
+	}
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Op != "write payload" {
+		t.Errorf("Expected a write payload StreamError, got %v", err)
+	}
+	if buf.Len() != len1 {
+		t.Errorf("Data was written after nonce exhaustion")
+	}
+
+	reader := NewShadowsocksReader(buf, cipher)
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(decrypted) != 128 {
+		t.Errorf("Wrong number of bytes out: %d", len(decrypted))
+	}
+}
+
+func TestLargeTag(t *testing.T) {
+	const overhead = 24
+	cipher := &insecureCipher{&insecureAEAD{nonceSize: 12, overhead: overhead}}
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+	data := MakeTestPayload(2*payloadSizeMask + 100)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	expectedLen := cipher.SaltSize() + 3*(2+overhead+overhead) + len(data)
+	if buf.Len() != expectedLen {
+		t.Errorf("Wrong stream length: %d != %d", buf.Len(), expectedLen)
+	}
+
+	for _, readSize := range []int{100, payloadSizeMask + overhead} {
+		reader := NewShadowsocksReader(bytes.NewReader(buf.Bytes()), cipher)
+		readBuf := make([]byte, readSize)
+		var decrypted []byte
+		for {
+			n, err := reader.Read(readBuf)
+			decrypted = append(decrypted, readBuf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("Wrong content with %d-byte reads", readSize)
+		}
+	}
+}
@@ -22,14 +22,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/Jigsaw-Code/outline-ss-server/metrics"
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
 	logging "github.com/op/go-logging"
-
-	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
 func remoteIP(conn net.Conn) net.IP {
@@ -145,13 +144,14 @@ type TCPService interface {
 
 // proxyConnection will route the clientConn according to the address read from the connection.
 func proxyConnection(clientConn onet.DuplexConn, proxyMetrics *metrics.ProxyMetrics, checkAllowedIP onet.IPPolicy) *onet.ConnectionError {
-	tgtAddr, err := socks.ReadAddr(clientConn)
+	tgtHost, tgtPort, err := ReadTargetAddress(clientConn)
 	if err != nil {
 		return onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", err)
 	}
-	tgtTCPAddr, err := net.ResolveTCPAddr("tcp", tgtAddr.String())
+	tgtAddr := net.JoinHostPort(tgtHost, strconv.Itoa(tgtPort))
+	tgtTCPAddr, err := net.ResolveTCPAddr("tcp", tgtAddr)
 	if err != nil {
-		return onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr.String()), err)
+		return onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
 	}
 	if err := checkAllowedIP(tgtTCPAddr.IP); err != nil {
 		return err
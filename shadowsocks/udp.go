@@ -15,6 +15,7 @@
 package shadowsocks
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -27,6 +28,7 @@ import (
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
 
 	"sync"
+	"sync/atomic"
 
 	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
@@ -72,9 +74,11 @@ func findAccessKeyUDP(clientIP net.IP, dst, src []byte, cipherList CipherList) (
 }
 
 type udpService struct {
-	mu             sync.RWMutex // Protects .clientConn and .stopped
-	clientConn     net.PacketConn
-	stopped        bool
+	mu         sync.RWMutex // Protects .clientConn, .stopped and .cancelNAT
+	clientConn net.PacketConn
+	stopped    bool
+	// Expires the NAT entries of Serve.
+	cancelNAT      context.CancelFunc
 	natTimeout     time.Duration
 	ciphers        CipherList
 	m              metrics.ShadowsocksMetrics
@@ -111,11 +115,14 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 		return clientConn.Close()
 	}
 	s.clientConn = clientConn
+	natCtx, cancelNAT := context.WithCancel(context.Background())
+	defer cancelNAT()
+	s.cancelNAT = cancelNAT
 	s.running.Add(1)
 	s.mu.Unlock()
 	defer s.running.Done()
 
-	nm := newNATmap(s.natTimeout, s.m, &s.running)
+	nm := newNATmap(natCtx, s.natTimeout, s.m, &s.running)
 	defer nm.Close()
 	cipherBuf := make([]byte, udpBufSize)
 	textBuf := make([]byte, udpBufSize)
@@ -231,6 +238,7 @@ func (s *udpService) Stop() error {
 	if s.clientConn == nil {
 		return nil
 	}
+	s.cancelNAT()
 	return s.clientConn.Close()
 }
 
@@ -251,11 +259,16 @@ type natconn struct {
 	// We store the client location in the NAT map to avoid recomputing it
 	// for every downstream packet in a UDP-based connection.
 	clientLocation string
-	// NAT timeout to apply for non-DNS packets.
-	defaultTimeout time.Duration
+	// Returns the current NAT timeout to apply for non-DNS packets.
+	defaultTimeout func() time.Duration
+	// mu protects readDeadline and expired.
+	mu sync.Mutex
 	// Current read deadline of PacketConn.  Used to avoid decreasing the
 	// deadline.  Initially zero.
 	readDeadline time.Time
+	// Indicates that the entry has been expired by its natmap, so writes
+	// must not extend the deadline.
+	expired bool
 	// If the connection has only sent one DNS query, it will close
 	// if it receives a DNS response.
 	fastClose sync.Once
@@ -265,18 +278,25 @@ func (c *natconn) onWrite(addr net.Addr) {
 	// Fast close is only allowed if there has been exactly one write,
 	// and it was a DNS query.
 	isDNS := isDNS(addr)
+	c.mu.Lock()
 	isFirstWrite := c.readDeadline.IsZero()
+	c.mu.Unlock()
 	if !isDNS || !isFirstWrite {
 		// Disable fast close.  (Idempotent.)
 		c.fastClose.Do(func() {})
 	}
 
-	timeout := c.defaultTimeout
+	timeout := c.defaultTimeout()
 	if isDNS {
 		// Shorten timeout as required by RFC 5452 Section 10.
 		timeout = 17 * time.Second
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return
+	}
 	newDeadline := time.Now().Add(timeout)
 	if newDeadline.After(c.readDeadline) {
 		c.readDeadline = newDeadline
@@ -284,6 +304,15 @@ func (c *natconn) onWrite(addr net.Addr) {
 	}
 }
 
+// expire makes the pending read, and every later one, time out, which ends
+// the entry's reader goroutine.
+func (c *natconn) expire() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expired = true
+	return c.SetReadDeadline(time.Now())
+}
+
 func (c *natconn) onRead(addr net.Addr) {
 	c.fastClose.Do(func() {
 		if isDNS(addr) {
@@ -308,20 +337,52 @@ func (c *natconn) ReadFrom(buf []byte) (int, net.Addr, error) {
 
 // Packet NAT table
 type natmap struct {
+	// timeout is a time.Duration.  It is accessed atomically, so it must be
+	// the first field to guarantee 64-bit alignment on 32-bit platforms.
+	timeout int64
+	// Number of entries added and expired.  Accessed atomically.
+	created int64
+	expired int64
 	sync.RWMutex
 	keyConn map[string]*natconn
-	timeout time.Duration
 	metrics metrics.ShadowsocksMetrics
 	running *sync.WaitGroup
+	// Closed by Close.
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func newNATmap(timeout time.Duration, sm metrics.ShadowsocksMetrics, running *sync.WaitGroup) *natmap {
-	m := &natmap{metrics: sm, running: running}
+// newNATmap returns an empty NAT map.  When `ctx` is done, the map is closed.
+func newNATmap(ctx context.Context, timeout time.Duration, sm metrics.ShadowsocksMetrics, running *sync.WaitGroup) *natmap {
+	m := &natmap{metrics: sm, running: running, done: make(chan struct{})}
 	m.keyConn = make(map[string]*natconn)
-	m.timeout = timeout
+	m.SetTimeout(timeout)
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				m.Close()
+			case <-m.done:
+			}
+		}()
+	}
 	return m
 }
 
+// Timeout returns the NAT timeout currently applied to non-DNS packets.
+func (m *natmap) Timeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.timeout))
+}
+
+// SetTimeout changes the NAT timeout for all entries, including existing ones.
+// The new value takes effect on each entry's next outbound packet, which
+// extends its read deadline to now + d.  Because read deadlines are never
+// moved earlier, shortening the timeout does not cut short an entry's
+// current deadline; that entry expires at the later of the two times.
+func (m *natmap) SetTimeout(d time.Duration) {
+	atomic.StoreInt64(&m.timeout, int64(d))
+}
+
 func (m *natmap) Get(key string) *natconn {
 	m.RLock()
 	defer m.RUnlock()
@@ -333,7 +394,7 @@ func (m *natmap) set(key string, pc net.PacketConn, cipher shadowaead.Cipher, cl
 		PacketConn:     pc,
 		cipher:         cipher,
 		clientLocation: clientLocation,
-		defaultTimeout: m.timeout,
+		defaultTimeout: m.Timeout,
 	}
 
 	m.Lock()
@@ -357,34 +418,75 @@ func (m *natmap) del(key string) net.PacketConn {
 
 func (m *natmap) Add(clientAddr net.Addr, clientConn net.PacketConn, cipher shadowaead.Cipher, targetConn net.PacketConn, clientLocation, keyID string) *natconn {
 	entry := m.set(clientAddr.String(), targetConn, cipher, clientLocation)
+	if m.isClosed() {
+		entry.expire()
+	}
 
 	m.metrics.AddUDPNatEntry()
 	m.running.Add(1)
+	atomic.AddInt64(&m.created, 1)
 	go func() {
 		timedCopy(clientAddr, clientConn, entry, keyID, m.metrics)
 		m.metrics.RemoveUDPNatEntry()
 		if pc := m.del(clientAddr.String()); pc != nil {
 			pc.Close()
 		}
+		atomic.AddInt64(&m.expired, 1)
 		m.running.Done()
 	}()
 	return entry
 }
 
+// natmapStats is a snapshot of the state of a natmap.
+type natmapStats struct {
+	// Number of entries whose reader goroutine is running.
+	Active int64
+	// Number of entries added since the map was created.
+	Created int64
+	// Number of entries whose reader goroutine has exited.
+	Expired int64
+}
+
+// Stats returns the current natmapStats.  Active is always Created - Expired,
+// so an Active count that keeps growing while traffic is steady points to
+// reader goroutines that never expire.  Operators see the same counts, summed
+// over all NAT maps, in the Prometheus metrics shadowsocks_udp_nat_entries_added,
+// shadowsocks_udp_nat_entries_removed and shadowsocks_udp_nat_entries_active,
+// which the map reports through AddUDPNatEntry and RemoveUDPNatEntry.
+func (m *natmap) Stats() natmapStats {
+	// Load expired first, so that a concurrent Add and expiry can't make
+	// Active negative.
+	expired := atomic.LoadInt64(&m.expired)
+	created := atomic.LoadInt64(&m.created)
+	return natmapStats{Active: created - expired, Created: created, Expired: expired}
+}
+
+// Close expires all entries.  Each entry's reader goroutine stops and closes
+// its target connection; callers can wait for this on the WaitGroup passed
+// to newNATmap.  Entries added after Close expire immediately.
 func (m *natmap) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
 	m.Lock()
 	defer m.Unlock()
 
 	var err error
-	now := time.Now()
-	for _, pc := range m.keyConn {
-		if e := pc.SetReadDeadline(now); e != nil {
+	for _, entry := range m.keyConn {
+		if e := entry.expire(); e != nil {
 			err = e
 		}
 	}
 	return err
 }
 
+func (m *natmap) isClosed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
 // Get the maximum length of the shadowsocks address header by parsing
 // and serializing an IPv6 address from the example range.
 var maxAddrLen int = len(socks.ParseAddr("[2001:db8::1]:12345"))
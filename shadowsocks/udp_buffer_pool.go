@@ -1,16 +1,33 @@
 package shadowsocks
 
-import "sync"
+import (
+	"sync"
 
-// maxUDPBufferSize is the maximum UDP packet size in bytes.
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// maxUDPBufferSize is the default maximum UDP packet size in bytes.
 const maxUDPBufferSize = 16 * 1024
 
-var pool = sync.Pool{
-	New: func() interface{} {
-		return make([]byte, maxUDPBufferSize)
-	},
+// maxUDPPayloadSize is the largest UDP payload over IPv4: 65535 bytes, minus
+// the 20-byte IP header and the 8-byte UDP header.
+const maxUDPPayloadSize = 65507
+
+// minUDPBufferSize is the smallest UDP buffer that can hold the largest salt,
+// the largest SOCKS address and the AEAD tag.
+const minUDPBufferSize = 32 + socks.MaxAddrLen + 16
+
+// newUDPBufferPool returns a pool of UDP buffers of `size` bytes.
+func newUDPBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, size)
+		},
+	}
 }
 
+var pool = newUDPBufferPool(maxUDPBufferSize)
+
 // newBuffer retrieves a UDP buffer from the pool.
 func newUDPBuffer() []byte {
 	return pool.Get().([]byte)
@@ -16,8 +16,10 @@ package shadowsocks
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"net"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -97,14 +99,14 @@ func assertAlmostEqual(t *testing.T, a, b time.Time) {
 }
 
 func TestNATEmpty(t *testing.T) {
-	nat := newNATmap(timeout, &probeTestMetrics{}, &sync.WaitGroup{})
+	nat := newNATmap(context.Background(), timeout, &probeTestMetrics{}, &sync.WaitGroup{})
 	if nat.Get("foo") != nil {
 		t.Error("Expected nil value from empty NAT map")
 	}
 }
 
 func setup() (*fakePacketConn, *fakePacketConn, *natconn) {
-	nat := newNATmap(timeout, &probeTestMetrics{}, &sync.WaitGroup{})
+	nat := newNATmap(context.Background(), timeout, &probeTestMetrics{}, &sync.WaitGroup{})
 	clientConn := makePacketConn()
 	targetConn := makePacketConn()
 	nat.Add(&clientAddr, clientConn, natCipher, targetConn, "ZZ", "key id")
@@ -138,6 +140,118 @@ func TestNATWrite(t *testing.T) {
 	}
 }
 
+func TestNATClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	nat := newNATmap(ctx, timeout, &probeTestMetrics{}, &running)
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	for i := 0; i < 5; i++ {
+		targetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := &net.UDPAddr{IP: clientAddr.IP, Port: clientAddr.Port + i}
+		entry := nat.Add(addr, clientConn, natCipher, targetConn, "ZZ", "key id")
+		entry.WriteTo([]byte{1}, clientConn.LocalAddr())
+	}
+	if runtime.NumGoroutine() <= before {
+		t.Fatal("Expected reader goroutines to be running")
+	}
+
+	cancel()
+	running.Wait()
+	for i := 0; i < 5; i++ {
+		if nat.Get((&net.UDPAddr{IP: clientAddr.IP, Port: clientAddr.Port + i}).String()) != nil {
+			t.Errorf("Entry %d was not removed", i)
+		}
+	}
+	// The goroutine watching ctx may take a moment to exit.
+	for i := 0; runtime.NumGoroutine() > before && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Leaked %d goroutines", after-before)
+	}
+
+	// Entries added after Close expire immediately, even though the write that
+	// follows Add would normally extend the deadline.
+	targetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := nat.Add(&clientAddr, clientConn, natCipher, targetConn, "ZZ", "key id")
+	entry.WriteTo([]byte{1}, clientConn.LocalAddr())
+	running.Wait()
+	if nat.Get(clientAddr.String()) != nil {
+		t.Error("Entry added after Close was not removed")
+	}
+}
+
+func TestNATStats(t *testing.T) {
+	var running sync.WaitGroup
+	nat := newNATmap(context.Background(), timeout, &probeTestMetrics{}, &running)
+	if stats := nat.Stats(); stats != (natmapStats{}) {
+		t.Errorf("Expected empty stats, got %+v", stats)
+	}
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	const numEntries = 5
+	for i := 0; i < numEntries; i++ {
+		targetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := &net.UDPAddr{IP: clientAddr.IP, Port: clientAddr.Port + i}
+		nat.Add(addr, clientConn, natCipher, targetConn, "ZZ", "key id")
+	}
+	expected := natmapStats{Active: numEntries, Created: numEntries}
+	if stats := nat.Stats(); stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+
+	nat.Close()
+	running.Wait()
+	expected = natmapStats{Active: 0, Created: numEntries, Expired: numEntries}
+	if stats := nat.Stats(); stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestNATSetTimeout(t *testing.T) {
+	nat := newNATmap(context.Background(), timeout, &probeTestMetrics{}, &sync.WaitGroup{})
+	clientConn := makePacketConn()
+	targetConn := makePacketConn()
+	entry := nat.Add(&clientAddr, clientConn, natCipher, targetConn, "ZZ", "key id")
+
+	entry.WriteTo([]byte{1}, &targetAddr)
+	<-targetConn.send
+	assertAlmostEqual(t, targetConn.deadline, time.Now().Add(timeout))
+
+	// A longer timeout applies to the existing entry on its next write.
+	longTimeout := 2 * timeout
+	nat.SetTimeout(longTimeout)
+	if nat.Timeout() != longTimeout {
+		t.Errorf("Timeout mismatch: %v != %v", nat.Timeout(), longTimeout)
+	}
+	entry.WriteTo([]byte{2}, &targetAddr)
+	<-targetConn.send
+	assertAlmostEqual(t, targetConn.deadline, time.Now().Add(longTimeout))
+
+	// A shorter timeout does not move the existing deadline earlier.
+	nat.SetTimeout(time.Second)
+	entry.WriteTo([]byte{3}, &targetAddr)
+	<-targetConn.send
+	assertAlmostEqual(t, targetConn.deadline, time.Now().Add(longTimeout))
+}
+
 func TestNATWriteDNS(t *testing.T) {
 	_, targetConn, entry := setup()
 